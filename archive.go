@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	manifestName    = "manifest.json"
+	archiveVersion  = 1
+	maxArchivedFile = 1 << 30
+)
+
+// manifest describes the content of an archive.
+type manifest struct {
+	Version int               `json:"version"`
+	Vars    []archivedVar     `json:"vars"`
+	Filters map[string]string `json:"filters,omitempty"`
+}
+
+// archivedVar is a dump var saved raw in File. As the ids of debug=1 records
+// aren't unique, tags are keyed by the position of the goroutines, which is
+// the same once the file is loaded and deduped again if Deduped.
+type archivedVar struct {
+	Name    string           `json:"name"`
+	File    string           `json:"file"`
+	Deduped bool             `json:"deduped,omitempty"`
+	Notes   []string         `json:"notes,omitempty"`
+	Tags    map[int][]string `json:"tags,omitempty"`
+	Noted   map[int][]string `json:"noted,omitempty"` // The notes of the goroutines.
+	Origins map[int]string   `json:"origins,omitempty"`
+}
+
+// archive saves the dump vars of the workspace, their tags and notes, and the
+// named filters into the zip file fn.
+func archive(fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	m := manifest{Version: archiveVersion, Filters: filters}
+	names := make([]string, 0, len(workspace))
+	for k := range workspace {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		gd := workspace[k]
+		av := archivedVar{Name: k, File: k + ".txt", Notes: gd.notes}
+		for i, g := range gd.goroutines {
+			// Unlike the debug=2 goroutines, the debug=1 records have
+			// counts without dedupe.
+			if len(g.duplicates) > 0 {
+				av.Deduped = true
+			}
+			if len(g.tags) > 0 {
+				if av.Tags == nil {
+					av.Tags = map[int][]string{}
+				}
+				av.Tags[i] = g.tags
+			}
+			if len(g.notes) > 0 {
+				if av.Noted == nil {
+					av.Noted = map[int][]string{}
+				}
+				av.Noted[i] = g.notes
+			}
+			if g.origin != "" {
+				if av.Origins == nil {
+					av.Origins = map[int]string{}
+				}
+				av.Origins[i] = g.origin
+			}
+		}
+		w, err := zw.Create(av.File)
+		if err != nil {
+			return err
+		}
+		if err := gd.Write(w, true); err != nil {
+			return err
+		}
+		m.Vars = append(m.Vars, av)
+	}
+
+	w, err := zw.Create(manifestName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// unarchive restores the dump vars and named filters saved by archive into
+// the workspace. It returns the names of the vars restored.
+func unarchive(fn string) ([]string, error) {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := map[string]*zip.File{}
+	for _, zf := range zr.File {
+		files[zf.Name] = zf
+	}
+	read := func(name string) ([]byte, error) {
+		zf, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("%s not found in archive %s", name, fn)
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(io.LimitReader(r, maxArchivedFile))
+	}
+
+	b, err := read(manifestName)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s", err)
+	}
+	if m.Version != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", m.Version)
+	}
+
+	// Load everything before changing the workspace.
+	dumps := make([]*GoroutineDump, len(m.Vars))
+	for i, av := range m.Vars {
+		if !identifierPattern.MatchString(av.Name) || identifierPattern.FindString(av.Name) != av.Name {
+			return nil, fmt.Errorf("invalid var name %q in archive", av.Name)
+		}
+		b, err := read(av.File)
+		if err != nil {
+			return nil, err
+		}
+		gd, err := parse(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", av.File, err)
+		}
+		if av.Deduped {
+			gd.Dedupe()
+		}
+		for idx, tags := range av.Tags {
+			if idx < 0 || idx >= len(gd.goroutines) {
+				return nil, fmt.Errorf("%s: tagged goroutine %d out of range", av.File, idx)
+			}
+			gd.goroutines[idx].tags = tags
+		}
+		for idx, notes := range av.Noted {
+			if idx < 0 || idx >= len(gd.goroutines) {
+				return nil, fmt.Errorf("%s: noted goroutine %d out of range", av.File, idx)
+			}
+			gd.goroutines[idx].notes = notes
+		}
+		for idx, origin := range av.Origins {
+			if idx < 0 || idx >= len(gd.goroutines) {
+				return nil, fmt.Errorf("%s: merged goroutine %d out of range", av.File, idx)
+			}
+			gd.goroutines[idx].origin = origin
+		}
+		gd.notes = av.Notes
+		dumps[i] = gd
+	}
+
+	names := make([]string, len(m.Vars))
+	for i, av := range m.Vars {
+		workspace[av.Name] = dumps[i]
+		names[i] = av.Name
+	}
+	for k, cond := range m.Filters {
+		filters[k] = strings.TrimSpace(cond)
+	}
+	return names, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	"github.com/sirupsen/logrus"
+)
+
+// Exit codes of the assert mode.
+const (
+	assertPassed = 0
+	assertFailed = 1
+	assertError  = 2
+)
+
+// assertionFailed is set once an assertion fails in the shell, which then
+// exits with assertFailed, so that scripts piped into it can gate a pipeline.
+var assertionFailed = false
+
+// Assert evaluates the assertion over the dump, an expression over the counts
+// of its goroutines which must be true, e.g.
+//
+//	count("contains(trace, 'leakyFunc')") == 0 && total < 5000
+//
+// count() takes a conditional or a search pattern, as the count() method, and
+// total is the number of goroutines. Both include the goroutines deduped into
+// one and those of a debug=1 record.
+func (gd *GoroutineDump) Assert(assertion string) (bool, error) {
+	assertion, conds := extractCounts(assertion)
+	params := map[string]interface{}{"total": float64(weightOf(gd.goroutines))}
+	for name, cond := range conds {
+		n, _, err := gd.Count(cond)
+		if err != nil {
+			return false, err
+		}
+		params[name] = float64(n)
+	}
+
+	counts := map[string]govaluate.ExpressionFunction{
+		"count": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, errors.New("count() accepts exactly one argument")
+			}
+			cond, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("count() expects a conditional or a pattern, got %v", args[0])
+			}
+			n, _, err := gd.Count(cond)
+			return float64(n), err
+		},
+	}
+	expression, err := govaluate.NewEvaluableExpressionWithFunctions(assertion, counts)
+	if err != nil {
+		return false, err
+	}
+	res, err := expression.Evaluate(params)
+	if err != nil {
+		return false, err
+	}
+	passed, ok := res.(bool)
+	if !ok {
+		return false, fmt.Errorf("assertion should return a boolean, got %v", res)
+	}
+	return passed, nil
+}
+
+// countCall matches the start of a count() call over a string literal.
+var countCall = regexp.MustCompile(`\bcount\(\s*(["'])`)
+
+// extractCounts replaces the count() calls over a string literal in the
+// assertion by parameters, returning the conditions they count by name.
+// govaluate ends a string literal at the first quote of either kind, so the
+// conditions can't be left to it once they have string literals of their own,
+// as in count("contains(trace, 'x')"). A quote of the literal's own kind is
+// escaped with a backslash. Other count() calls are left to the function.
+func extractCounts(assertion string) (string, map[string]string) {
+	conds := map[string]string{}
+	var sb strings.Builder
+	for {
+		loc := countCall.FindStringSubmatchIndex(assertion)
+		if loc == nil {
+			break
+		}
+		quote := assertion[loc[2]]
+		end := -1 // Of the literal, at its closing quote.
+		for i := loc[3]; i < len(assertion); i++ {
+			if assertion[i] == '\\' {
+				i++
+			} else if assertion[i] == quote {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			break
+		}
+		rest := strings.TrimLeft(assertion[end+1:], " \t")
+		if !strings.HasPrefix(rest, ")") {
+			sb.WriteString(assertion[:loc[3]])
+			assertion = assertion[loc[3]:]
+			continue
+		}
+		name := fmt.Sprintf("count#%d", len(conds))
+		conds[name] = strings.ReplaceAll(assertion[loc[3]:end], `\`+string(quote), string(quote))
+		sb.WriteString(assertion[:loc[0]] + "[" + name + "]")
+		assertion = rest[1:]
+	}
+	sb.WriteString(assertion)
+	return sb.String(), conds
+}
+
+// assertFiles evaluates the assertion over each of the dump files, printing
+// whether it holds, and returns the exit code of the assert mode: non-zero if
+// it fails for any of them or can't be evaluated.
+func assertFiles(assertion string, files []string) int {
+	if assertion == "" || len(files) == 0 {
+		logrus.Error("expect \"assert <assertion> <file>...\"")
+		return assertError
+	}
+	code := assertPassed
+	for _, fn := range files {
+		d, err := load(fn)
+		if err != nil {
+			logrus.Error(err)
+			return assertError
+		}
+		applyNoise(d)
+		passed, err := d.Assert(assertion)
+		if err != nil {
+			logrus.Errorf("%s: %s", fn, err)
+			return assertError
+		}
+		if passed {
+			fmt.Printf("%s: passed\n", fn)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: assertion failed: %s\n", fn, strings.TrimSpace(assertion))
+			code = assertFailed
+		}
+	}
+	return code
+}
@@ -6,6 +6,7 @@ import (
 	"go/ast"
 	"go/parser"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -47,11 +48,30 @@ func assign(cmd string) error {
 						if len(ex.Args) > 1 {
 							return errors.New("copy expects zero or one argument")
 						}
-						if len(ex.Args) == 0 {
-							workspace[k] = val.Copy("")
-						} else {
-							workspace[k] = val.Copy(ex.Args[0].(*ast.BasicLit).Value)
+						cond := ""
+						if len(ex.Args) == 1 {
+							cond = ex.Args[0].(*ast.BasicLit).Value
+						}
+						dump, err := val.Copy(cond)
+						if err != nil {
+							return err
 						}
+						workspace[k] = dump
+					case "partition":
+						if len(ex.Args) != 1 {
+							return errors.New("partition() expects exactly one argument")
+						}
+						args := strings.Split(k, ",")
+						if len(args) != 2 {
+							return errors.New("partition() expects two result receivers")
+						}
+						matched, others, err := val.Partition(ex.Args[0].(*ast.BasicLit).Value)
+						if err != nil {
+							return err
+						}
+						workspace[strings.TrimSpace(args[0])] = matched
+						workspace[strings.TrimSpace(args[1])] = others
+						report(result{"matched": len(matched.goroutines), "others": len(others.goroutines)}, "%d goroutines matched, %d not.\n", len(matched.goroutines), len(others.goroutines))
 					case "diff":
 						if len(ex.Args) != 1 {
 							return errors.New("diff() expects exactly one argument")
@@ -73,6 +93,9 @@ func assign(cmd string) error {
 								if len(args) == 3 {
 									workspace[strings.TrimSpace(args[2])] = ronly
 								}
+								if v.deduped() || val.deduped() {
+									printGroupDeltas(GroupDeltas(v, val))
+								}
 							} else {
 								return fmt.Errorf("variable %s not found in workspace", s)
 							}
@@ -87,17 +110,103 @@ func assign(cmd string) error {
 					return fmt.Errorf("variable %s not found in workspace", s)
 				}
 			case *ast.Ident:
-				if fun.Name == "load" {
+				switch fun.Name {
+				case "load":
+					if len(ex.Args) == 0 {
+						return errors.New("load() expects at least one argument")
+					}
+					origins := make([]string, len(ex.Args))
+					dumps := make([]*GoroutineDump, len(ex.Args))
+					for i, arg := range ex.Args {
+						fn := arg.(*ast.BasicLit).Value
+						progress, done := printProgress(fn)
+						dump, err := loadContext(statementCtx, fn, progress)
+						done()
+						if err != nil {
+							return err
+						}
+						origins[i], dumps[i] = strings.Trim(fn, "\""), dump
+						printWarnings(dump)
+						applyNoise(dump)
+					}
+					dump := dumps[0]
+					if len(dumps) > 1 {
+						dump = Merge(origins, dumps)
+					}
+					workspace[k] = dump
+					printSummary(dump)
+				case "merge":
+					if len(ex.Args) < 2 {
+						return errors.New("merge() expects at least two arguments")
+					}
+					origins := make([]string, len(ex.Args))
+					dumps := make([]*GoroutineDump, len(ex.Args))
+					for i, arg := range ex.Args {
+						id, ok := arg.(*ast.Ident)
+						if !ok {
+							return errors.New("merge() expects dump vars as arguments")
+						}
+						v, ok := workspace[id.Name]
+						if !ok {
+							return fmt.Errorf("variable %s not found in workspace", id.Name)
+						}
+						origins[i], dumps[i] = id.Name, v
+					}
+					dump := Merge(origins, dumps)
+					workspace[k] = dump
+					printSummary(dump)
+				case "capture":
 					if len(ex.Args) != 1 {
-						return errors.New("load() expects exactly one argument")
+						return errors.New("capture() expects exactly one argument")
+					}
+					arg := ex.Args[0].(*ast.BasicLit).Value
+					cmd, err := strconv.Unquote(arg)
+					if err != nil {
+						return fmt.Errorf("invalid argument 'cmd' %s", arg)
 					}
-					dump, err := load(ex.Args[0].(*ast.BasicLit).Value)
+					dump, err := capture(cmd)
 					if err != nil {
 						return err
 					}
 					workspace[k] = dump
-					dump.Summary()
-				} else {
+					printWarnings(dump)
+					applyNoise(dump)
+					printSummary(dump)
+				case "attach":
+					sigquit := false
+					switch len(ex.Args) {
+					case 1:
+					case 2:
+						if mode := strings.Trim(ex.Args[1].(*ast.BasicLit).Value, "\""); mode != "sigquit" {
+							return fmt.Errorf("unknown attach mode %s", mode)
+						}
+						sigquit = true
+					default:
+						return errors.New("attach() expects one or two arguments")
+					}
+					pid, err := strconv.Atoi(ex.Args[0].(*ast.BasicLit).Value)
+					if err != nil {
+						return fmt.Errorf("invalid argument 'pid' %s", ex.Args[0])
+					}
+					if sigquit {
+						pmpt := fmt.Sprintf("SIGQUIT terminates process %d, continue? y/[N]: ", pid)
+						confirm, err := line.Prompt(pmpt)
+						if err != nil {
+							return err
+						}
+						if strings.ToLower(strings.TrimSpace(confirm)) != "y" {
+							return nil
+						}
+					}
+					dump, err := attach(pid, sigquit)
+					if err != nil {
+						return err
+					}
+					workspace[k] = dump
+					printWarnings(dump)
+					applyNoise(dump)
+					printSummary(dump)
+				default:
 					return fmt.Errorf("unknown instrution %s", fun.Name)
 				}
 			default:
@@ -105,7 +214,11 @@ func assign(cmd string) error {
 			}
 		case *ast.Ident:
 			if v, ok := workspace[ex.String()]; ok {
-				workspace[k] = v.Copy("")
+				dump, err := v.Copy("")
+				if err != nil {
+					return err
+				}
+				workspace[k] = dump
 			} else {
 				return fmt.Errorf("variable %s not found in workspace", ex.String())
 			}
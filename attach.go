@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gopsStackTrace is the gops agent request for the goroutine stacks.
+const gopsStackTrace = 0x1
+
+var errNoAgent = errors.New("no gops agent found")
+
+// attach obtains a goroutine dump from the local process pid, through its
+// gops agent (github.com/google/gops), or by sending it SIGQUIT and reading
+// its standard error if sigquit is true. The latter terminates the process.
+func attach(pid int, sigquit bool) (*GoroutineDump, error) {
+	var data []byte
+	var err error
+	if sigquit {
+		data, err = dumpBySignal(pid)
+	} else {
+		data, err = dumpByAgent(pid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	dump, err := parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	dump.parseTime = time.Since(start)
+	return dump, nil
+}
+
+// dumpByAgent requests the goroutine stacks from the gops agent of pid.
+func dumpByAgent(pid int) ([]byte, error) {
+	port, err := gopsPort(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+port, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{gopsStackTrace}); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(conn)
+}
+
+// gopsPort returns the port the gops agent of pid listens on, which the agent
+// writes into a file named after the pid in its config dir.
+func gopsPort(pid int) (string, error) {
+	var dirs []string
+	if dir := os.Getenv("GOPS_CONFIG_DIR"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, "gops"))
+	}
+	if dir, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, ".config", "gops"))
+	}
+
+	for _, dir := range dirs {
+		b, err := os.ReadFile(filepath.Join(dir, fmt.Sprint(pid)))
+		if err == nil {
+			return strings.TrimSpace(string(b)), nil
+		}
+	}
+	return "", fmt.Errorf("%w for process %d, try attach(%d, \"sigquit\")", errNoAgent, pid, pid)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// dumpBySignal sends SIGQUIT to pid, which makes the Go runtime print all the
+// goroutine stacks to the standard error before exiting. The standard error
+// must be redirected to a file, from which the new content is read.
+func dumpBySignal(pid int) ([]byte, error) {
+	fn, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/2", pid))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("the standard error of process %d is %s, not a file", pid, fn)
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(fi.Size(), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGQUIT); err != nil {
+		return nil, err
+	}
+
+	// Wait until the process stops writing.
+	deadline := time.Now().Add(30 * time.Second)
+	size := fi.Size()
+	for stable := 0; stable < 5 && time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() == size {
+			stable++
+		} else {
+			size, stable = fi.Size(), 0
+		}
+	}
+	return io.ReadAll(f)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// dumpBySignal is only supported on Linux, where the standard error of a
+// process can be found in /proc.
+func dumpBySignal(pid int) ([]byte, error) {
+	return nil, errors.New("attaching with SIGQUIT is only supported on Linux")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	// auditPath is the file every command executed is appended to, with
+	// when it ran and the counts it resulted in. Empty for none.
+	auditPath string
+	auditLog  io.WriteCloser
+
+	// auditJSON writes the audit log as JSON lines instead of text which can
+	// be piped back into the shell to replay the analysis.
+	auditJSON = false
+)
+
+func setAudit(path string) error {
+	if auditLog != nil {
+		auditLog.Close()
+		auditPath, auditLog = "", nil
+	}
+	if path == "0" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	auditPath, auditLog = path, f
+	return nil
+}
+
+func setAuditFormat(s string) error {
+	switch s {
+	case "text", "json":
+		auditJSON = s == "json"
+		return nil
+	}
+	return fmt.Errorf("expect text or json, got %q", s)
+}
+
+// audit appends the command started at start to the audit log, along with
+// the result it reported. The text format comments the command with them:
+//
+//	# 2026-10-15T10:02:03+02:00 (1.52ms) {"deleted":533,"kept":1684}
+//	original.delete("state == 'IO wait'")
+func audit(cmd string, start time.Time) {
+	if auditLog == nil || runningConfFile {
+		return
+	}
+
+	r := result{}
+	if cmd != "result" {
+		for k, v := range lastResult {
+			if k != "statement" {
+				r[k] = v
+			}
+		}
+	}
+	elapsed := time.Since(start).Round(time.Microsecond)
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if auditJSON {
+		r["time"] = start.Format(time.RFC3339Nano)
+		r["duration"] = elapsed.String()
+		r["statement"] = cmd
+		enc.Encode(r)
+	} else {
+		fmt.Fprintf(&b, "# %s (%s) ", start.Format(time.RFC3339), elapsed)
+		enc.Encode(r)
+		fmt.Fprintln(&b, cmd)
+	}
+	if _, err := auditLog.Write(b.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing the audit log %s.\n", err)
+	}
+}
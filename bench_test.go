@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/linuxerwang/goroutine-inspect/dumpgen"
+)
+
+var benchSizes = []int{10000, 100000, 1000000}
+
+// benchDumps caches the generated dumps by size, as generating them takes
+// longer than some of the benchmarks.
+var benchDumps = map[int][]byte{}
+
+func benchDump(b *testing.B, n int) []byte {
+	if n >= 1000000 && testing.Short() {
+		b.Skip("skipping the largest dump in short mode")
+	}
+	if d, ok := benchDumps[n]; ok {
+		return d
+	}
+	var buf bytes.Buffer
+	if err := dumpgen.Generate(&buf, dumpgen.Options{Goroutines: n, Seed: 1}); err != nil {
+		b.Fatal(err)
+	}
+	benchDumps[n] = buf.Bytes()
+	return buf.Bytes()
+}
+
+func benchParse(b *testing.B, data []byte) *GoroutineDump {
+	d, err := parse(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return d
+}
+
+func BenchmarkLoad(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			data := benchDump(b, n)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				benchParse(b, data)
+			}
+		})
+	}
+}
+
+func BenchmarkDedupe(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			d := benchParse(b, benchDump(b, n))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c, err := d.Copy("")
+				if err != nil {
+					b.Fatal(err)
+				}
+				c.Dedupe()
+			}
+		})
+	}
+}
+
+func BenchmarkFilter(b *testing.B) {
+	for _, cond := range []string{"duration > 30", "contains(trace, 'pubsub') && state == 'select'"} {
+		for _, n := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%d", cond, n), func(b *testing.B) {
+				d := benchParse(b, benchDump(b, n))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, _, err := d.Search(cond, 0, 0); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompress returns a reader of the decompressed content if br starts with a
+// gzip or zstd header, or nil if it's not compressed.
+func decompress(br *bufio.Reader) (io.ReadCloser, error) {
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, nil
+}
+
+// compress returns a writer compressing into w according to the extension of
+// fn, or a writer to w itself if there is no matching extension. The returned
+// writer must be closed to flush the compressed content.
+func compress(w io.Writer, fn string) (io.WriteCloser, error) {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".gz":
+		return gzip.NewWriter(w), nil
+	case ".zst":
+		return zstd.NewWriter(w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// isBinary tells if the content looks like a binary pprof profile rather than
+// a text dump.
+func isBinary(head []byte) bool {
+	for _, b := range head {
+		if b < 0x09 || (b > 0x0d && b < 0x20) {
+			return true
+		}
+	}
+	return false
+}
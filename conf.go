@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"log"
 	"os"
 	"os/user"
@@ -30,6 +31,35 @@ func getConfFile() string {
 	return filepath.Join(getConfDir(), "config")
 }
 
+// runningConfFile is set while the commands in the config file run.
+var runningConfFile bool
+
+// runConfFile runs the commands in the config file, one per line. Empty lines
+// and lines starting with "#" are ignored.
+func runConfFile() {
+	f, err := os.Open(getConfFile())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	runningConfFile = true
+	defer func() { runningConfFile = false }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" || strings.HasPrefix(cmd, "#") {
+			continue
+		}
+		execute(cmd)
+	}
+}
+
+func getPluginDir() string {
+	return filepath.Join(getConfDir(), "plugins")
+}
+
 func getHistoryFile() string {
 	return filepath.Join(getConfDir(), "history")
 }
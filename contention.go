@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Contention is how much the goroutines blocked in a function waited, by a
+// block or mutex profile.
+type Contention struct {
+	Function string
+	Delay    time.Duration
+	Count    int64
+}
+
+// loadContention reads a block or mutex profile, either the protobuf or the
+// legacy text format, and sums the contention by the innermost function
+// outside of the runtime of each sample.
+func loadContention(fn string) (map[string]*Contention, error) {
+	f, err := os.Open(strings.Trim(fn, "\""))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := profile.Parse(f)
+	if err != nil {
+		return nil, err
+	}
+
+	delayIdx, countIdx := -1, -1
+	for i, st := range p.SampleType {
+		switch {
+		case st.Type == "delay" || st.Unit == "nanoseconds":
+			delayIdx = i
+		case st.Type == "contentions" || st.Unit == "count":
+			countIdx = i
+		}
+	}
+	if delayIdx < 0 || countIdx < 0 {
+		return nil, fmt.Errorf("%s is not a block or mutex profile", fn)
+	}
+
+	hot := map[string]*Contention{}
+	for _, s := range p.Sample {
+		site := contentionSite(s)
+		if site == "" {
+			continue
+		}
+		c := hot[site]
+		if c == nil {
+			c = &Contention{Function: site}
+			hot[site] = c
+		}
+		c.Delay += time.Duration(s.Value[delayIdx])
+		c.Count += s.Value[countIdx]
+	}
+	return hot, nil
+}
+
+// contentionSite returns the innermost function of the sample outside of the
+// runtime, where the goroutines waiting for the same lock or channel are
+// blocked as well.
+func contentionSite(s *profile.Sample) string {
+	for _, loc := range s.Location {
+		for _, ln := range loc.Line {
+			if ln.Function != nil && !isRuntimePackage(pkgName(ln.Function.Name)) {
+				return ln.Function.Name
+			}
+		}
+	}
+	return ""
+}
+
+// CrossReference marks the goroutines blocked in a function the contention
+// profile also reports. It returns the hot spots, the most delayed first,
+// and the number of goroutines marked in each of them.
+func (gd *GoroutineDump) CrossReference(hot map[string]*Contention) ([]*Contention, map[string]int) {
+	marked := map[string]int{}
+	for i, g := range gd.goroutines {
+		if g.external {
+			continue
+		}
+		c := hot[g.leafFunc()]
+		if c == g.contention {
+			if c != nil {
+				marked[c.Function] += g.weight()
+			}
+			continue
+		}
+		// Copy the goroutine as it may be shared by other dumps.
+		m := *g
+		m.contention = c
+		gd.goroutines[i] = &m
+		if c != nil {
+			marked[c.Function] += g.weight()
+		}
+	}
+
+	spots := make([]*Contention, 0, len(hot))
+	for _, c := range hot {
+		spots = append(spots, c)
+	}
+	sort.Slice(spots, func(i, j int) bool {
+		if spots[i].Delay != spots[j].Delay {
+			return spots[i].Delay > spots[j].Delay
+		}
+		return spots[i].Function < spots[j].Function
+	})
+	return spots, marked
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// noiseFilters are the conditions of the goroutines dropped from each dump
+	// loaded, set in the defaults file.
+	noiseFilters []string
+
+	// aliases are the statements run by typing their name, set in the
+	// defaults file.
+	aliases = map[string]string{}
+
+	// defaultFilters are the filters defined by the defaults file, which are
+	// not saved to the config file unless redefined.
+	defaultFilters = map[string]string{}
+)
+
+// defaults is the YAML defaults file, applied at startup. Anything it sets
+// can be changed for the session with "set" or "deffilter".
+type defaults struct {
+	Options map[string]string `yaml:"options"` // As set by "set <name> <value>".
+	Filters map[string]string `yaml:"filters"` // As defined by "deffilter".
+	Noise   []string          `yaml:"noise"`   // Conditions, or "@<filter-name>".
+	Aliases map[string]string `yaml:"aliases"`
+}
+
+func getDefaultsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "goroutine-inspect", "config.yaml")
+}
+
+// loadDefaults applies the defaults file, if it exists.
+func loadDefaults(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var d defaults
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&d); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %s", fn, err)
+	}
+
+	names := make([]string, 0, len(d.Options))
+	for k := range d.Options {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		opt, ok := options[k]
+		if !ok {
+			return fmt.Errorf("%s: unknown option %s", fn, k)
+		}
+		if err := opt.set(d.Options[k]); err != nil {
+			return fmt.Errorf("%s: option %s: %s", fn, k, err)
+		}
+	}
+
+	for k, cond := range d.Filters {
+		if !identifierPattern.MatchString(k) || identifierPattern.FindString(k) != k {
+			return fmt.Errorf("%s: invalid filter name %s", fn, k)
+		}
+		filters[k] = strings.TrimSpace(cond)
+		defaultFilters[k] = filters[k]
+	}
+	for _, k := range filterNames() {
+		if _, err := expandFilters(filters[k]); err != nil {
+			return fmt.Errorf("%s: filter %s: %s", fn, k, err)
+		}
+	}
+
+	for _, cond := range d.Noise {
+		if _, err := checkCondition(cond); err != nil {
+			return fmt.Errorf("%s: noise %s: %s", fn, cond, err)
+		}
+	}
+	noiseFilters = d.Noise
+
+	for k, stmt := range d.Aliases {
+		if _, ok := commands[k]; ok || !identifierPattern.MatchString(k) || identifierPattern.FindString(k) != k {
+			return fmt.Errorf("%s: invalid alias name %s", fn, k)
+		}
+		aliases[k] = strings.TrimSpace(stmt)
+	}
+	return nil
+}
+
+// applyNoise drops the goroutines meeting the noise filters from the dump
+// just loaded, and tells how many.
+func applyNoise(gd *GoroutineDump) {
+	n, err := dropNoise(gd)
+	if err != nil {
+		fmt.Printf("Error, %s.\n", err.Error())
+	}
+	if n > 0 {
+		fmt.Printf("Dropped %d noise goroutines.\n", n)
+	}
+}
+
+// dropNoise deletes the goroutines meeting the noise filters from the dump.
+// It returns the number of goroutines deleted.
+func dropNoise(gd *GoroutineDump) (int, error) {
+	dropped := 0
+	for _, cond := range noiseFilters {
+		n, err := gd.Delete(cond)
+		if err != nil {
+			return dropped, fmt.Errorf("noise %s: %s", cond, err)
+		}
+		dropped += n
+	}
+	return dropped, nil
+}
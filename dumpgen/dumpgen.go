@@ -0,0 +1,91 @@
+// Package dumpgen generates synthetic goroutine dumps in the debug=2 format,
+// for benchmarking goroutine-inspect on dumps of any size.
+package dumpgen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+)
+
+// Options controls the generated dump.
+type Options struct {
+	Goroutines int   // Number of goroutines.
+	Signatures int   // Number of distinct stack signatures, 100 if zero.
+	MaxDepth   int   // Maximum number of frames besides the creator, 20 if zero.
+	Seed       int64 // Seed of the pseudo-random choices, for reproducible dumps.
+}
+
+var (
+	states = []string{"chan receive", "select", "IO wait", "sync.Mutex.Lock", "semacquire", "sleep", "runnable", "syscall"}
+
+	packages  = []string{"main", "net/http", "google.golang.org/grpc/internal/transport", "github.com/example/service/pubsub", "database/sql"}
+	receivers = []string{"", "(*Server).", "(*conn).", "(*Broker).", "(*Pool).", "(*worker)."}
+	verbs     = []string{"serve", "wait", "read", "loop", "handle", "Subscribe", "dispatch", "poll"}
+)
+
+// frame is a function and its location.
+type frame struct {
+	fn, file string
+	line     int
+}
+
+// signature is a stack shared by several goroutines.
+type signature struct {
+	state   string
+	frames  []frame
+	creator frame
+}
+
+// Generate writes a synthetic dump to w.
+func Generate(w io.Writer, opts Options) error {
+	if opts.Signatures <= 0 {
+		opts.Signatures = 100
+	}
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = 20
+	}
+	r := rand.New(rand.NewSource(opts.Seed))
+
+	sigs := make([]signature, opts.Signatures)
+	for i := range sigs {
+		sigs[i] = newSignature(r, opts.MaxDepth)
+	}
+
+	bw := bufio.NewWriter(w)
+	for id := 1; id <= opts.Goroutines; id++ {
+		// Skew the sizes of the groups, like real dumps where a few stacks
+		// account for most goroutines.
+		sig := sigs[int(float64(len(sigs))*r.Float64()*r.Float64())]
+		fmt.Fprintf(bw, "goroutine %d [%s", id, sig.state)
+		if m := r.Intn(60); m > 0 && sig.state != "runnable" {
+			fmt.Fprintf(bw, ", %d minutes", m)
+		}
+		fmt.Fprint(bw, "]:\n")
+		for _, f := range sig.frames {
+			fmt.Fprintf(bw, "%s(0x%x, 0x%x)\n\t%s:%d +0x%x\n", f.fn, r.Uint32(), r.Uint32(), f.file, f.line, r.Intn(0x400))
+		}
+		fmt.Fprintf(bw, "created by %s in goroutine %d\n\t%s:%d +0x%x\n\n", sig.creator.fn, 1+r.Intn(id), sig.creator.file, sig.creator.line, r.Intn(0x400))
+	}
+	return bw.Flush()
+}
+
+func newSignature(r *rand.Rand, maxDepth int) signature {
+	sig := signature{state: states[r.Intn(len(states))]}
+	depth := 1 + r.Intn(maxDepth)
+	for i := 0; i < depth; i++ {
+		sig.frames = append(sig.frames, newFrame(r))
+	}
+	sig.creator = newFrame(r)
+	return sig
+}
+
+func newFrame(r *rand.Rand) frame {
+	pkg := packages[r.Intn(len(packages))]
+	return frame{
+		fn:   pkg + "." + receivers[r.Intn(len(receivers))] + verbs[r.Intn(len(verbs))],
+		file: fmt.Sprintf("/src/%s/file%d.go", pkg, r.Intn(20)),
+		line: 1 + r.Intn(1000),
+	}
+}
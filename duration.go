@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	headerDurationPattern = regexp.MustCompile(`, (\d+) minutes([,\]])`)
+
+	// captureTime is when the dumps were taken, to tell when the goroutines
+	// started waiting. Zero if it's unknown.
+	captureTime time.Time
+
+	captureTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04"}
+)
+
+func setCaptureTime(s string) error {
+	if s == "0" {
+		captureTime = time.Time{}
+		return nil
+	}
+	for _, layout := range captureTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			captureTime = t
+			return nil
+		}
+	}
+	return fmt.Errorf("expect a time like \"2006-01-02 15:04\", got %q", s)
+}
+
+// formatMinutes renders minutes as days, hours and minutes, e.g. "1h32m".
+func formatMinutes(minutes int) string {
+	if minutes <= 0 {
+		return "0m"
+	}
+	var sb strings.Builder
+	if d := minutes / (24 * 60); d > 0 {
+		fmt.Fprintf(&sb, "%dd", d)
+	}
+	if h := minutes / 60 % 24; h > 0 {
+		fmt.Fprintf(&sb, "%dh", h)
+	}
+	if m := minutes % 60; m > 0 {
+		fmt.Fprintf(&sb, "%dm", m)
+	}
+	return sb.String()
+}
+
+// waitingSince returns when a goroutine waiting for minutes at the capture
+// time started to wait, "" if the capture time is unknown. The runtime
+// rounds the wait down to the minute, hence the "~".
+func waitingSince(minutes int) string {
+	if captureTime.IsZero() {
+		return ""
+	}
+	since := captureTime.Add(-time.Duration(minutes) * time.Minute)
+	layout := "15:04"
+	if since.YearDay() != captureTime.YearDay() || since.Year() != captureTime.Year() {
+		layout = "Jan 2 15:04"
+	}
+	return "~" + since.Format(layout)
+}
+
+// displayHeader renders the wait in a goroutine header readably, along with
+// when it started if the capture time is known.
+func displayHeader(header string) string {
+	return headerDurationPattern.ReplaceAllStringFunc(header, func(s string) string {
+		m := headerDurationPattern.FindStringSubmatch(s)
+		minutes, _ := strconv.Atoi(m[1])
+		d := formatMinutes(minutes)
+		if since := waitingSince(minutes); since != "" {
+			d += " since " + since
+		}
+		return ", " + d + m[2]
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rule explains the goroutines whose stack trace matches its pattern.
+type rule struct {
+	pattern     *regexp.Regexp
+	explanation string
+}
+
+var (
+	// defaultRules cover well known goroutines of the standard library.
+	defaultRules = []rule{
+		{regexp.MustCompile(`net/http\.\(\*conn\)\.serve`), "http.Server connection waiting for or serving a request, normal"},
+		{regexp.MustCompile(`net/http\.\(\*Server\)\.Serve\b`), "http.Server accepting connections, normal"},
+		{regexp.MustCompile(`net/http\.\(\*persistConn\)\.readLoop`), "http.Transport keep-alive connection reader, normal"},
+		{regexp.MustCompile(`net/http\.\(\*persistConn\)\.writeLoop`), "http.Transport keep-alive connection writer, normal"},
+		{regexp.MustCompile(`net/http\.\(\*http2serverConn\)\.serve`), "http2 server connection, normal"},
+		{regexp.MustCompile(`database/sql\.\(\*DB\)\.connectionOpener`), "database/sql connection opener, normal"},
+		{regexp.MustCompile(`os/signal\.(signal_recv|loop)`), "os/signal notification loop, normal"},
+		{regexp.MustCompile(`context\.propagateCancel`), "context cancellation propagation, normal unless numerous"},
+		{regexp.MustCompile(`time\.Sleep\(`), "sleeping in time.Sleep"},
+		{regexp.MustCompile(`sync\.\(\*WaitGroup\)\.Wait`), "waiting for a sync.WaitGroup"},
+		{regexp.MustCompile(`sync\.\(\*R?WMutex\)\.R?Lock|sync\.\(\*Mutex\)\.Lock`), "waiting for a mutex, check its holder if numerous"},
+		{regexp.MustCompile(`sync\.\(\*Cond\)\.Wait`), "waiting for a sync.Cond"},
+	}
+
+	// userRules are loaded from the rules file and take precedence over the
+	// default ones.
+	userRules []rule
+)
+
+func getRulesFile() string {
+	return filepath.Join(getConfDir(), "rules")
+}
+
+// loadRules reads the rules file, one "<regexp> => <explanation>" per line.
+// Empty lines and lines starting with "#" are ignored.
+func loadRules(fn string) ([]rule, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []rule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		idx := strings.Index(l, "=>")
+		if idx < 0 {
+			return nil, fmt.Errorf("%s:%d: expect \"<regexp> => <explanation>\"", fn, n)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(l[:idx]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fn, n, err)
+		}
+		rules = append(rules, rule{re, strings.TrimSpace(l[idx+2:])})
+	}
+	return rules, scanner.Err()
+}
+
+// explain returns the explanation of the first rule matching the goroutine,
+// or "" if none does.
+func explain(g *Goroutine) string {
+	trace := g.buf.String()
+	for _, rules := range [][]rule{userRules, defaultRules} {
+		for _, r := range rules {
+			if r.pattern.MatchString(trace) {
+				return r.explanation
+			}
+		}
+	}
+	return ""
+}
+
+// explainedTag labels the goroutines explained by explain().
+const explainedTag = "explained"
+
+// Explanation counts the goroutines given an explanation.
+type Explanation struct {
+	Text       string
+	Count      int
+	Signatures int
+}
+
+// Explain matches the stack signatures of the dump against the rules, and
+// returns the explanations given, the largest count first, along with the
+// unexplained goroutines and signatures. The goroutines explained, and the
+// members of their groups, are given the explanation, the "explanation" field
+// in conditionals, and tagged "explained".
+func (gd *GoroutineDump) Explain() (explained []Explanation, unexplained, signatures int) {
+	counts, samples := gd.countSignatures()
+	texts := make(map[string]string, len(counts))
+	byText := map[string]*Explanation{}
+	for sig, n := range counts {
+		text := explain(samples[sig])
+		texts[sig] = text
+		if text == "" {
+			unexplained += n
+			signatures++
+			continue
+		}
+		e, ok := byText[text]
+		if !ok {
+			e = &Explanation{Text: text}
+			byText[text] = e
+		}
+		e.Count += n
+		e.Signatures++
+	}
+
+	for _, g := range gd.goroutines {
+		text := texts[g.scrubbedHash]
+		for _, m := range append([]*Goroutine{g}, g.members...) {
+			m.explanation = text
+			if text != "" && !m.hasTag(explainedTag) {
+				// Never append in place, like Tag.
+				m.tags = append(m.tags[:len(m.tags):len(m.tags)], explainedTag)
+			}
+		}
+	}
+
+	for _, e := range byText {
+		explained = append(explained, *e)
+	}
+	sort.Slice(explained, func(i, j int) bool {
+		if explained[i].Count != explained[j].Count {
+			return explained[i].Count > explained[j].Count
+		}
+		return explained[i].Text < explained[j].Text
+	})
+	return explained, unexplained, signatures
+}
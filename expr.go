@@ -6,11 +6,14 @@ import (
 	"go/ast"
 	"go/parser"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+
+	sgr "github.com/foize/go.sgr"
 )
 
-func expr(e string) error {
+func expr(e string) (err error) {
 	ex, err := parser.ParseExpr(e)
 	if err != nil {
 		return err
@@ -22,83 +25,562 @@ func expr(e string) error {
 		case *ast.SelectorExpr:
 			k := fun.X.(*ast.Ident).Name
 			if v, ok := workspace[k]; ok {
+				if undoable[fun.Sel.Name] {
+					before := v.snapshot()
+					defer func() {
+						if err == nil {
+							journal(k, e, v, before)
+						}
+					}()
+				}
 				switch fun.Sel.Name {
 				case "delete":
-					if len(ex.Args) != 1 {
-						return errors.New("keep() expects exactly one argument")
+					dryRun, err := dryRunArg("delete", ex.Args)
+					if err != nil {
+						return err
 					}
-					return v.Delete(ex.Args[0].(*ast.BasicLit).Value)
+					cond := ex.Args[0].(*ast.BasicLit).Value
+					if dryRun {
+						_, count, err := v.Search(cond, 0, 0)
+						if err != nil {
+							return err
+						}
+						report(result{"deleted": count, "kept": len(v.Goroutines()) - count, "dry_run": true}, "Would delete %d goroutines, keep %d.\n", count, len(v.Goroutines())-count)
+						return nil
+					}
+					deleted, err := v.Delete(cond)
+					if err != nil {
+						return err
+					}
+					report(result{"deleted": deleted, "kept": len(v.Goroutines())}, "Deleted %d goroutines, kept %d.\n", deleted, len(v.Goroutines()))
+					return nil
 				case "dedupe":
 					if len(ex.Args) != 0 {
 						return errors.New("dedup() expects no arguments")
 					}
-					v.Dedupe()
+					removed := v.Dedupe()
+					r := result{"deduped": removed + len(v.Goroutines()), "kept": len(v.Goroutines())}
+					if removed > 0 {
+						report(r, "dedupped %d, kept %d\n", removed+len(v.Goroutines()), len(v.Goroutines()))
+					} else {
+						lastResult = r
+					}
 					return nil
-				case "keep":
+				case "expand":
 					if len(ex.Args) != 1 {
-						return errors.New("delete() expects exactly one argument")
+						return errors.New("expand() expects exactly one argument")
 					}
-					return v.Keep(ex.Args[0].(*ast.BasicLit).Value)
-				case "save":
-					if len(ex.Args) != 1 {
-						return errors.New("save() expects exactly one argument")
+					id, err := strconv.Atoi(ex.Args[0].(*ast.BasicLit).Value)
+					if err != nil {
+						return fmt.Errorf("invalid argument 'id' %s", ex.Args[0])
 					}
-					fn := strings.Trim(ex.Args[0].(*ast.BasicLit).Value, "\"")
-					if _, err := os.Stat(fn); err == nil {
-						pmpt := fmt.Sprintf("File %s already exists, overwrite it? [Y]/n: ", fn)
-						var confirm string
-						if confirm, err = line.Prompt(pmpt); err != nil {
+					g := v.Find(id)
+					if g == nil {
+						return fmt.Errorf("goroutine %d not found in %s", id, k)
+					}
+					g.PrintWithColor()
+					return nil
+				case "keep":
+					dryRun, err := dryRunArg("keep", ex.Args)
+					if err != nil {
+						return err
+					}
+					cond := ex.Args[0].(*ast.BasicLit).Value
+					if dryRun {
+						_, count, err := v.Search(cond, 0, 0)
+						if err != nil {
 							return err
 						}
-						confirm = strings.ToLower(strings.TrimSpace(confirm))
-						if confirm != "y" && confirm != "" {
-							return nil
+						report(result{"deleted": len(v.Goroutines()) - count, "kept": count, "dry_run": true}, "Would delete %d goroutines, keep %d.\n", len(v.Goroutines())-count, count)
+						return nil
+					}
+					deleted, err := v.Keep(cond)
+					if err != nil {
+						return err
+					}
+					report(result{"deleted": deleted, "kept": len(v.Goroutines())}, "Deleted %d goroutines, kept %d.\n", deleted, len(v.Goroutines()))
+					return nil
+				case "keepstate", "older_than", "newer_than":
+					cond, err := shortcutCondition(fun.Sel.Name, ex.Args)
+					if err != nil {
+						return err
+					}
+					deleted, err := v.Keep(cond)
+					if err != nil {
+						return err
+					}
+					report(result{"deleted": deleted, "kept": len(v.Goroutines())}, "Deleted %d goroutines, kept %d.\n", deleted, len(v.Goroutines()))
+					return nil
+				case "save":
+					raw := saveRaw
+					switch len(ex.Args) {
+					case 1:
+					case 2:
+						switch mode := strings.Trim(ex.Args[1].(*ast.BasicLit).Value, "\""); mode {
+						case "raw":
+							raw = true
+						case "pretty":
+							raw = false
+						default:
+							return fmt.Errorf("unknown save mode %s", mode)
 						}
+					default:
+						return errors.New("save() expects one or two arguments")
+					}
+					fn := strings.Trim(ex.Args[0].(*ast.BasicLit).Value, "\"")
+					if ok, err := confirmOverwrite(fn); !ok {
+						return err
 					}
-					if err := v.Save(fn); err != nil {
+					if err := v.Save(fn, raw); err != nil {
 						return err
 					}
 					fmt.Printf("Goroutines are saved to file %s.\n", fn)
+					return nil
+				case "save_pprof":
+					if len(ex.Args) != 1 {
+						return errors.New("save_pprof() expects exactly one argument")
+					}
+					fn := strings.Trim(ex.Args[0].(*ast.BasicLit).Value, "\"")
+					if ok, err := confirmOverwrite(fn); !ok {
+						return err
+					}
+					if err := v.SavePprof(fn); err != nil {
+						return err
+					}
+					fmt.Printf("Goroutines are saved to pprof profile %s.\n", fn)
 				case "search":
-					var err error
-					offset := 0
-					limit := 10
-					switch len(ex.Args) {
-					case 0:
+					if len(ex.Args) == 0 {
 						return errors.New("search() expects at least one argument")
+					} else if len(ex.Args) > 3 {
+						return errors.New("search() expects at most three arguments")
+					}
+					offset, limit, err := pageArgs(ex.Args[1:])
+					if err != nil {
+						return err
+					}
+					arg := ex.Args[0].(*ast.BasicLit).Value
+					if isCondition(arg) {
+						return paginate(func(offset, limit int) (int, error) {
+							found, count, err := v.Search(arg, offset, limit)
+							if err != nil {
+								return 0, err
+							}
+							sgr.Printf("[fg-green]Search with offset %d and limit %d.[reset]\n\n", offset, limit)
+							printGoroutines(found, nil)
+							lastResult = result{"found": count}
+							return count, nil
+						}, offset, limit)
+					}
+					re := compilePattern(arg)
+					return paginate(func(offset, limit int) (int, error) {
+						found, count := v.Grep(re, offset, limit)
+						sgr.Printf("[fg-green]Search with offset %d and limit %d.[reset]\n\n", offset, limit)
+						printGoroutines(found, re)
+						report(result{"found": count}, "Found %d goroutines.\n", count)
+						return count, nil
+					}, offset, limit)
+				case "tag":
+					if len(ex.Args) != 2 {
+						return errors.New("tag() expects exactly two arguments")
+					}
+					name := ex.Args[1].(*ast.BasicLit).Value
+					tagged, err := v.Tag(ex.Args[0].(*ast.BasicLit).Value, name)
+					if err != nil {
+						return err
+					}
+					report(result{"tagged": tagged}, "Tagged %d goroutines with %s.\n", tagged, name)
+					return nil
+				case "show_tag":
+					if len(ex.Args) != 1 {
+						return errors.New("show_tag() expects exactly one argument")
+					}
+					printGoroutines(v.Tagged(ex.Args[0].(*ast.BasicLit).Value), nil)
+					return nil
+				case "note":
+					switch len(ex.Args) {
 					case 1:
-					case 2:
-						offset, err = strconv.Atoi(ex.Args[1].(*ast.BasicLit).Value)
-						if err != nil {
-							return fmt.Errorf("invalid argument %s", ex.Args[1])
+						if err := v.Note(ex.Args[0].(*ast.BasicLit).Value); err != nil {
+							return err
 						}
-					case 3:
-						offset, err = strconv.Atoi(ex.Args[1].(*ast.BasicLit).Value)
+					case 2:
+						id, err := strconv.Atoi(ex.Args[0].(*ast.BasicLit).Value)
 						if err != nil {
-							return fmt.Errorf("invalid argument 'offset' %s", ex.Args[1])
+							return fmt.Errorf("invalid argument 'id' %s", ex.Args[0])
 						}
-						limit, err = strconv.Atoi(ex.Args[2].(*ast.BasicLit).Value)
-						if err != nil {
-							return fmt.Errorf("invalid argument 'limit' %s", ex.Args[2])
+						if err := v.NoteGoroutine(id, ex.Args[1].(*ast.BasicLit).Value); err != nil {
+							return err
 						}
 					default:
-						return errors.New("search() expects at most three arguments")
+						return errors.New("note() expects one or two arguments")
 					}
-					v.Search(ex.Args[0].(*ast.BasicLit).Value, offset, limit)
+					return nil
+				case "notes":
+					if len(ex.Args) != 0 {
+						return errors.New("notes() expects no arguments")
+					}
+					printNotes(v)
+					return nil
+				case "contention":
+					if len(ex.Args) != 1 {
+						return errors.New("contention() expects exactly one argument")
+					}
+					hot, err := loadContention(ex.Args[0].(*ast.BasicLit).Value)
+					if err != nil {
+						return err
+					}
+					spots, marked := v.CrossReference(hot)
+					printContention(spots, marked, 10)
+					return nil
+				case "assert":
+					if len(ex.Args) != 1 {
+						return errors.New("assert() expects exactly one argument")
+					}
+					arg := ex.Args[0].(*ast.BasicLit).Value
+					assertion, err := strconv.Unquote(arg)
+					if err != nil {
+						return fmt.Errorf("invalid argument 'assertion' %s", arg)
+					}
+					passed, err := v.Assert(assertion)
+					if err != nil {
+						return err
+					}
+					if passed {
+						report(result{"passed": true}, "Assertion passed.\n")
+					} else {
+						assertionFailed = true
+						report(result{"passed": false}, "Assertion failed: %s\n", assertion)
+					}
+					return nil
+				case "count":
+					if len(ex.Args) != 1 {
+						return errors.New("count() expects exactly one argument")
+					}
+					count, total, err := v.Count(ex.Args[0].(*ast.BasicLit).Value)
+					if err != nil {
+						return err
+					}
+					report(result{"matched": count, "total": total}, "%d of %d goroutines match.\n", count, total)
 					return nil
 				case "show":
-					v.Show()
+					if len(ex.Args) > 2 {
+						return errors.New("show() expects at most two arguments")
+					}
+					offset, limit, err := pageArgs(ex.Args)
+					if err != nil {
+						return err
+					}
+					if len(ex.Args) == 0 {
+						// All of them, unless paged.
+						limit = len(v.Goroutines())
+					}
+					return paginate(func(offset, limit int) (int, error) {
+						gs := v.Goroutines()
+						if offset > 0 && offset >= len(gs) {
+							return 0, fmt.Errorf("offset %d is beyond the %d goroutines", offset, len(gs))
+						}
+						end := offset + limit
+						if end > len(gs) {
+							end = len(gs)
+						}
+						if len(gs) == 0 {
+							fmt.Println("No goroutines to show.")
+							return 0, nil
+						}
+						printGoroutines(gs[offset:end], nil)
+						report(result{"shown": end - offset, "total": len(gs)}, "Shown %d to %d of %d goroutines.\n", offset+1, end, len(gs))
+						return len(gs), nil
+					}, offset, limit)
+				case "strip":
+					if len(ex.Args) != 1 {
+						return errors.New("strip() expects exactly one argument")
+					}
+					n, err := v.Strip(ex.Args[0].(*ast.BasicLit).Value)
+					if err != nil {
+						return err
+					}
+					report(result{"changed": n}, "Stripped frames from %d goroutines.\n", n)
+					return nil
+				case "symbolize":
+					if len(ex.Args) != 0 {
+						return errors.New("symbolize() expects no arguments")
+					}
+					if symbols == nil {
+						return errors.New("no binary to symbolize with, \"set binary <path>\" first")
+					}
+					n := v.Symbolize(symbols)
+					report(result{"changed": n}, "Symbolized %d goroutines.\n", n)
+					return nil
+				case "truncate":
+					if len(ex.Args) != 1 {
+						return errors.New("truncate() expects exactly one argument")
+					}
+					depth, err := intArg(ex.Args[0])
+					if err != nil || depth < 0 {
+						return fmt.Errorf("invalid argument 'depth' %s", exprString(ex.Args[0]))
+					}
+					n := v.Truncate(depth)
+					report(result{"changed": n}, "Truncated %d goroutines to %d frames.\n", n, depth)
+					return nil
+				case "explain":
+					if len(ex.Args) != 0 {
+						return errors.New("explain() expects no arguments")
+					}
+					printExplanations(v.Explain())
+					return nil
+				case "requests":
+					if len(ex.Args) != 0 {
+						return errors.New("requests() expects no arguments")
+					}
+					groups := v.Requests()
+					printRequests(groups)
+					total := 0
+					for _, rg := range groups {
+						total += rg.Requests
+					}
+					lastResult = result{"requests": total}
+					return nil
+				case "stuck":
+					if len(ex.Args) != 1 {
+						return errors.New("stuck() expects exactly one argument")
+					}
+					minutes, err := intArg(ex.Args[0])
+					if err != nil || minutes < 0 {
+						return fmt.Errorf("invalid argument 'minutes' %s", exprString(ex.Args[0]))
+					}
+					stuck, total := v.Stuck(minutes)
+					printStuck(stuck, total, minutes)
+					return nil
+				case "groupby":
+					if len(ex.Args) != 1 {
+						return errors.New("groupby() expects exactly one argument")
+					}
+					field := strings.Trim(ex.Args[0].(*ast.BasicLit).Value, "\"")
+					counts, err := v.GroupBy(field)
+					if err != nil {
+						return err
+					}
+					printGroups(field, counts)
+					lastResult = result{"groups": counts}
+					return nil
+				case "summary_by_origin":
+					bySignature := false
+					switch len(ex.Args) {
+					case 0:
+					case 1:
+						switch by := strings.Trim(ex.Args[0].(*ast.BasicLit).Value, "\""); by {
+						case "states":
+						case "signatures":
+							bySignature = true
+						default:
+							return fmt.Errorf("unknown summary rows %s", by)
+						}
+					default:
+						return errors.New("summary_by_origin() expects at most one argument")
+					}
+					origins, dumps := v.ByOrigin()
+					if len(origins) < 2 {
+						return fmt.Errorf("%s is not merged from several dumps", k)
+					}
+					for i, o := range origins {
+						if o == "" {
+							origins[i] = "(none)"
+						}
+					}
+					m := SummaryAll(dumps, bySignature)
+					printSummaryMatrix(origins, m)
+					printSkew(origins, m.Totals)
+					return nil
+				case "stats":
+					if len(ex.Args) != 0 {
+						return errors.New("stats() expects no arguments")
+					}
+					printStats(k, v)
+					printMemStats()
 					return nil
 				default:
 					return fmt.Errorf("unknown instruction")
 				}
 			}
+		case *ast.Ident:
+			switch fun.Name {
+			case "stats":
+				if len(ex.Args) != 0 {
+					return errors.New("stats() expects no arguments")
+				}
+				names := make([]string, 0, len(workspace))
+				for k := range workspace {
+					names = append(names, k)
+				}
+				sort.Strings(names)
+				for _, k := range names {
+					printStats(k, workspace[k])
+				}
+				printMemStats()
+				return nil
+			case "leaks":
+				limit := 10
+				switch len(ex.Args) {
+				case 2:
+				case 3:
+					var err error
+					limit, err = strconv.Atoi(ex.Args[2].(*ast.BasicLit).Value)
+					if err != nil {
+						return fmt.Errorf("invalid argument 'limit' %s", ex.Args[2])
+					}
+				default:
+					return errors.New("leaks() expects two or three arguments")
+				}
+				dumps := make([]*GoroutineDump, 2)
+				for i, arg := range ex.Args[:2] {
+					id, ok := arg.(*ast.Ident)
+					if !ok {
+						return fmt.Errorf("invalid argument %s", arg)
+					}
+					if dumps[i], ok = workspace[id.Name]; !ok {
+						return fmt.Errorf("variable %s not found in workspace", id.Name)
+					}
+				}
+				printLeaks(Leaks(dumps[0], dumps[1]), limit)
+				return nil
+			case "report_md":
+				if len(ex.Args) != 2 && len(ex.Args) != 3 {
+					return errors.New("report_md() expects two or three arguments")
+				}
+				names := make([]string, len(ex.Args)-1)
+				dumps := make([]*GoroutineDump, len(ex.Args)-1)
+				for i, arg := range ex.Args[1:] {
+					id, ok := arg.(*ast.Ident)
+					if !ok {
+						return fmt.Errorf("invalid argument %s", arg)
+					}
+					if dumps[i], ok = workspace[id.Name]; !ok {
+						return fmt.Errorf("variable %s not found in workspace", id.Name)
+					}
+					names[i] = id.Name
+				}
+				fn := strings.Trim(ex.Args[0].(*ast.BasicLit).Value, "\"")
+				if fn != "-" {
+					if ok, err := confirmOverwrite(fn); !ok {
+						return err
+					}
+				}
+				if err := saveReport(fn, names, dumps); err != nil {
+					return err
+				}
+				if fn != "-" {
+					fmt.Printf("Report is written to file %s.\n", fn)
+				}
+				return nil
+			case "archive":
+				if len(ex.Args) != 1 {
+					return errors.New("archive() expects exactly one argument")
+				}
+				fn := strings.Trim(ex.Args[0].(*ast.BasicLit).Value, "\"")
+				if ok, err := confirmOverwrite(fn); !ok {
+					return err
+				}
+				if err := archive(fn); err != nil {
+					return err
+				}
+				fmt.Printf("Workspace is archived to file %s.\n", fn)
+				return nil
+			case "unarchive":
+				if len(ex.Args) != 1 {
+					return errors.New("unarchive() expects exactly one argument")
+				}
+				names, err := unarchive(strings.Trim(ex.Args[0].(*ast.BasicLit).Value, "\""))
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Restored vars: %s\n", strings.Join(names, ", "))
+				return nil
+			case "check":
+				if len(ex.Args) != 1 {
+					return errors.New("check() expects exactly one argument")
+				}
+				lit, ok := ex.Args[0].(*ast.BasicLit)
+				if !ok {
+					return fmt.Errorf("invalid argument %s", ex.Args[0])
+				}
+				vars, err := checkCondition(lit.Value)
+				if err != nil {
+					return err
+				}
+				if len(vars) == 0 {
+					fmt.Println("Valid condition, using no fields.")
+				} else {
+					fmt.Printf("Valid condition over %s.\n", strings.Join(vars, ", "))
+				}
+				return nil
+			case "summary_all":
+				bySignature := false
+				switch len(ex.Args) {
+				case 0:
+				case 1:
+					switch by := strings.Trim(ex.Args[0].(*ast.BasicLit).Value, "\""); by {
+					case "states":
+					case "signatures":
+						bySignature = true
+					default:
+						return fmt.Errorf("unknown summary rows %s", by)
+					}
+				default:
+					return errors.New("summary_all() expects at most one argument")
+				}
+				names, dumps := workspaceDumps()
+				printSummaryMatrix(names, SummaryAll(dumps, bySignature))
+				return nil
+			case "track":
+				if len(ex.Args) == 0 {
+					return errors.New("track() expects at least one argument")
+				}
+				lit, ok := ex.Args[0].(*ast.BasicLit)
+				if !ok {
+					return fmt.Errorf("invalid argument 'id' %s", ex.Args[0])
+				}
+				id, err := strconv.Atoi(lit.Value)
+				if err != nil {
+					return fmt.Errorf("invalid argument 'id' %s", lit.Value)
+				}
+				names, dumps := workspaceDumps()
+				if len(ex.Args) > 1 {
+					names, dumps = nil, nil
+					for _, arg := range ex.Args[1:] {
+						v, ok := arg.(*ast.Ident)
+						if !ok {
+							return fmt.Errorf("invalid argument %s", arg)
+						}
+						gd, ok := workspace[v.Name]
+						if !ok {
+							return fmt.Errorf("variable %s not found in workspace", v.Name)
+						}
+						names, dumps = append(names, v.Name), append(dumps, gd)
+					}
+				}
+				if len(dumps) == 0 {
+					return errors.New("no dumps in the workspace")
+				}
+				printTrack(id, names, Track(dumps, id))
+				return nil
+			case "plugin":
+				if len(ex.Args) != 1 {
+					return errors.New("plugin() expects exactly one argument")
+				}
+				names, err := loadPlugin(ex.Args[0].(*ast.BasicLit).Value)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Registered functions: %s\n", strings.Join(names, ", "))
+				return nil
+			default:
+				return fmt.Errorf("unknown instruction")
+			}
 		default:
 			return fmt.Errorf("unknown instruction")
 		}
 	case *ast.Ident:
 		if v, ok := workspace[ex.String()]; ok {
-			v.Summary()
+			printSummary(v)
 		} else {
 			return fmt.Errorf("variable %s not found in workspace", e)
 		}
@@ -108,3 +590,76 @@ func expr(e string) error {
 
 	return nil
 }
+
+// shortcutCondition returns the conditional of the keep() shortcuts
+// keepstate("<state>"), older_than(minutes) and newer_than(minutes).
+func shortcutCondition(name string, args []ast.Expr) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("%s() expects exactly one argument", name)
+	}
+	lit, ok := args[0].(*ast.BasicLit)
+	if !ok {
+		return "", fmt.Errorf("invalid argument %s", args[0])
+	}
+
+	if name == "keepstate" {
+		state := strings.Trim(lit.Value, "\"")
+		if strings.Contains(state, "'") {
+			return "", fmt.Errorf("invalid state %s", lit.Value)
+		}
+		return fmt.Sprintf("state == '%s'", state), nil
+	}
+
+	minutes, err := strconv.Atoi(lit.Value)
+	if err != nil {
+		return "", fmt.Errorf("invalid argument 'minutes' %s", lit.Value)
+	}
+	if name == "older_than" {
+		return fmt.Sprintf("duration >= %d", minutes), nil
+	}
+	return fmt.Sprintf("duration < %d", minutes), nil
+}
+
+// dryRunArg checks the arguments of delete() and keep(), a condition and
+// optionally "dry-run", and tells if it's a dry run.
+func dryRunArg(name string, args []ast.Expr) (bool, error) {
+	switch len(args) {
+	case 1:
+		return false, nil
+	case 2:
+		if mode := strings.Trim(args[1].(*ast.BasicLit).Value, "\""); mode != "dry-run" {
+			return false, fmt.Errorf("unknown %s mode %s", name, mode)
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("%s() expects one or two arguments", name)
+}
+
+// confirmOverwrite asks whether to overwrite fn if it already exists.
+func confirmOverwrite(fn string) (bool, error) {
+	if _, err := os.Stat(fn); err != nil {
+		return true, nil
+	}
+	pmpt := fmt.Sprintf("File %s already exists, overwrite it? [Y]/n: ", fn)
+	confirm, err := line.Prompt(pmpt)
+	if err != nil {
+		return false, err
+	}
+	confirm = strings.ToLower(strings.TrimSpace(confirm))
+	return confirm == "y" || confirm == "", nil
+}
+
+// workspaceDumps returns the variables of the workspace and their dumps,
+// sorted by name.
+func workspaceDumps() ([]string, []*GoroutineDump) {
+	names := make([]string, 0, len(workspace))
+	for k := range workspace {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	dumps := make([]*GoroutineDump, len(names))
+	for i, k := range names {
+		dumps[i] = workspace[k]
+	}
+	return names, dumps
+}
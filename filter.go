@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	deffilterPattern = regexp.MustCompile(`^\s*deffilter(\s+.*)?$`)
+	filterRefPattern = regexp.MustCompile(`^@[_a-zA-Z][_a-zA-Z0-9]*`)
+
+	// filters are the named filters, referenced as "@name" in conditionals.
+	filters = map[string]string{}
+)
+
+// deffilter handles "deffilter" to list the named filters, "deffilter <name>"
+// to show one, and "deffilter <name> <condition>" to define one. An empty
+// condition removes the filter.
+func deffilter(cmd string) error {
+	args := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmd), "deffilter"))
+	if args == "" {
+		if len(filters) == 0 {
+			fmt.Println("No filters defined.")
+		}
+		for _, k := range filterNames() {
+			fmt.Printf("  %15s: %s\n", k, filters[k])
+		}
+		return nil
+	}
+
+	name, cond := args, ""
+	if idx := strings.IndexAny(args, " \t"); idx > 0 {
+		name, cond = args[:idx], strings.TrimSpace(args[idx+1:])
+	}
+	if !identifierPattern.MatchString(name) || identifierPattern.FindString(name) != name {
+		return fmt.Errorf("invalid filter name %s", name)
+	}
+	if cond == "" {
+		cond, ok := filters[name]
+		if !ok {
+			return fmt.Errorf("filter %s not defined", name)
+		}
+		fmt.Printf("%s: %s\n", name, cond)
+		return nil
+	}
+
+	cond = strings.Trim(cond, "\"")
+	if cond == "" {
+		delete(filters, name)
+	} else {
+		filters[name] = cond
+		// The config file may define filters before the ones they reference.
+		if _, err := expandFilters(cond); err != nil && !runningConfFile {
+			delete(filters, name)
+			return err
+		}
+	}
+	return saveFilters()
+}
+
+func filterNames() []string {
+	names := make([]string, 0, len(filters))
+	for k := range filters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quoteFilterRefs quotes the filter references given as arguments in the
+// command, so that "a.keep(@leaky)" reads "a.keep("@leaky")".
+func quoteFilterRefs(cmd string) string {
+	var sb strings.Builder
+	var quote byte
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case quote != 0:
+			if c == quote && cmd[i-1] != '\\' {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '@':
+			if ref := filterRefPattern.FindString(cmd[i:]); ref != "" {
+				sb.WriteString(`"` + ref + `"`)
+				i += len(ref) - 1
+				continue
+			}
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// expandFilters replaces the filter references in cond with their
+// parenthesized conditions.
+func expandFilters(cond string) (string, error) {
+	return expandFiltersDepth(cond, 0)
+}
+
+func expandFiltersDepth(cond string, depth int) (string, error) {
+	if !strings.Contains(cond, "@") {
+		return cond, nil
+	}
+	if depth > len(filters) {
+		return "", errors.New("filters reference each other in a cycle")
+	}
+
+	var sb strings.Builder
+	var quote byte // Of the string literal c is in, if any.
+	for i := 0; i < len(cond); i++ {
+		c := cond[i]
+		switch {
+		case quote != 0:
+			if c == quote && cond[i-1] != '\\' {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || cond[i-1] != '\\'):
+			quote = c
+		case c == '@':
+			if ref := filterRefPattern.FindString(cond[i:]); ref != "" {
+				def, ok := filters[ref[1:]]
+				if !ok {
+					return "", fmt.Errorf("filter %s not defined", ref)
+				}
+				expanded, err := expandFiltersDepth(def, depth+1)
+				if err != nil {
+					return "", err
+				}
+				sb.WriteString("(" + expanded + ")")
+				i += len(ref) - 1
+				continue
+			}
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), nil
+}
+
+// saveFilters writes the filter definitions to the config file, replacing the
+// previous ones and keeping the other commands.
+func saveFilters() error {
+	if runningConfFile {
+		return nil
+	}
+
+	var lines []string
+	if f, err := os.Open(getConfFile()); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if !deffilterPattern.MatchString(scanner.Text()) {
+				lines = append(lines, scanner.Text())
+			}
+		}
+		f.Close()
+	}
+	for _, k := range filterNames() {
+		if cond, ok := defaultFilters[k]; ok && cond == filters[k] {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("deffilter %s \"%s\"", k, filters[k]))
+	}
+
+	f, err := os.Create(getConfFile())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, l := range lines {
+		fmt.Fprintln(f, l)
+	}
+	return f.Close()
+}
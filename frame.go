@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+)
+
+// runtimePackages are skipped when looking for the package a goroutine is
+// blocked in, since nearly all goroutines park in them.
+var runtimePackages = []string{"runtime", "internal/", "sync", "syscall"}
+
+// funcName returns the function name of a frame's function line, of either
+// the debug=1 or the debug=2 format.
+func funcName(l string) string {
+	if strings.HasPrefix(l, "#\t") {
+		// #	0x4dea98	main.worker+0x18	/app/main.go:10
+		parts := strings.Split(l, "\t")
+		if len(parts) < 3 {
+			return ""
+		}
+		name := parts[2]
+		if idx := strings.LastIndex(name, "+0x"); idx > 0 {
+			name = name[:idx]
+		}
+		return name
+	}
+
+	l = strings.TrimPrefix(l, "created by ")
+	if idx := strings.Index(l, " in goroutine "); idx > 0 {
+		l = l[:idx]
+	}
+	// Drop the argument list, the parenthesis of a method receiver such as
+	// "net/http.(*conn).serve(...)" come right after a dot.
+	if idx := strings.LastIndex(l, "("); idx > 0 && l[idx-1] != '.' {
+		l = l[:idx]
+	}
+	return l
+}
+
+// pkgName returns the package path of a function name.
+func pkgName(fn string) string {
+	slash := strings.LastIndex(fn, "/")
+	if dot := strings.Index(fn[slash+1:], "."); dot >= 0 {
+		return fn[:slash+1+dot]
+	}
+	return fn
+}
+
+func isRuntimePackage(pkg string) bool {
+	for _, p := range runtimePackages {
+		if pkg == p || strings.HasPrefix(pkg, p+"/") || (strings.HasSuffix(p, "/") && strings.HasPrefix(pkg, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// leafPackage returns the package of the innermost frame outside of the
+// runtime, or of the innermost frame if all of them are in the runtime.
+func (st *stack) leafPackage() string {
+	pkg := ""
+	for _, f := range st.frames {
+		p := pkgName(funcName(f[0]))
+		if pkg == "" {
+			pkg = p
+		}
+		if !isRuntimePackage(p) {
+			return p
+		}
+	}
+	return pkg
+}
+
+// leafFunc returns the innermost function outside of the runtime, or the
+// innermost function if all of them are in the runtime.
+func (g *Goroutine) leafFunc() string {
+	st := splitStack(g.buf.String())
+	fn := ""
+	for _, f := range st.frames {
+		name := funcName(f[0])
+		if fn == "" {
+			fn = name
+		}
+		if !isRuntimePackage(pkgName(name)) {
+			return name
+		}
+	}
+	return fn
+}
+
+// creatorPackage returns the package of the function which created the
+// goroutine, or "" if it's unknown.
+func (st *stack) creatorPackage() string {
+	if len(st.creator) == 0 {
+		return ""
+	}
+	return pkgName(funcName(st.creator[0]))
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unsafe"
 
 	"os"
 
@@ -27,6 +31,26 @@ var (
 
 	durationPattern = regexp.MustCompile(`^\d+ minutes$`)
 
+	highlightStart = sgr.MustParse("[bg-yellow fg-black]")
+	highlightEnd   = sgr.MustParse("[reset]")
+
+	// conditionFields are the goroutine properties usable in conditionals,
+	// and how to get them.
+	conditionFields = map[string]func(g *Goroutine) interface{}{
+		"id":          func(g *Goroutine) interface{} { return g.id },
+		"dups":        func(g *Goroutine) interface{} { return g.Dups() },
+		"duration":    func(g *Goroutine) interface{} { return g.duration },
+		"lines":       func(g *Goroutine) interface{} { return g.lines },
+		"state":       func(g *Goroutine) interface{} { return g.metas[MetaState] },
+		"state_class": func(g *Goroutine) interface{} { return stateClass(g.metas[MetaState]) },
+		"trace":       func(g *Goroutine) interface{} { return g.buf.String() },
+		"tags":        func(g *Goroutine) interface{} { return g.tags },
+		"external":    func(g *Goroutine) interface{} { return g.external },
+		"contended":   func(g *Goroutine) interface{} { return g.contention != nil },
+		"origin":      func(g *Goroutine) interface{} { return g.origin },
+		"explanation": func(g *Goroutine) interface{} { return g.explanation },
+	}
+
 	functions = map[string]govaluate.ExpressionFunction{
 		"contains": func(args ...interface{}) (interface{}, error) {
 			if len(args) != 2 {
@@ -35,6 +59,23 @@ var (
 			idx := strings.Index(args[0].(string), args[1].(string))
 			return bool(idx > -1), nil
 		},
+		"icontains": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("icontains() accepts exactly two arguments")
+			}
+			idx := strings.Index(strings.ToLower(args[0].(string)), strings.ToLower(args[1].(string)))
+			return bool(idx > -1), nil
+		},
+		"fuzzy": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 3 {
+				return nil, fmt.Errorf("fuzzy() accepts exactly three arguments")
+			}
+			maxdist, ok := toFloat(args[2])
+			if !ok || maxdist < 0 {
+				return nil, fmt.Errorf("fuzzy() expects a non-negative distance, got %v", args[2])
+			}
+			return fuzzyContains(args[0].(string), args[1].(string), int(maxdist)), nil
+		},
 		"lower": func(args ...interface{}) (interface{}, error) {
 			if len(args) != 1 {
 				return nil, fmt.Errorf("lower() accepts exactly one arguments")
@@ -49,64 +90,367 @@ var (
 			uppered := strings.ToUpper(args[0].(string))
 			return string(uppered), nil
 		},
+		"has_tag": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("has_tag() accepts exactly one argument")
+			}
+			tags, _ := args[0].([]string)
+			for _, t := range tags {
+				if t == args[1] {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+		"file": func(args ...interface{}) (interface{}, error) {
+			f, err := frameArg("file", args)
+			if err != nil || f == nil {
+				return "", err
+			}
+			_, _, file, _ := parseFrame(f)
+			return file, nil
+		},
+		"line": func(args ...interface{}) (interface{}, error) {
+			f, err := frameArg("line", args)
+			if err != nil || f == nil {
+				return float64(0), err
+			}
+			_, _, _, line := parseFrame(f)
+			return float64(line), nil
+		},
+		"in": func(args ...interface{}) (interface{}, error) {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("in() accepts at least two arguments")
+			}
+			for _, v := range args[1:] {
+				if equalValues(args[0], v) {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+		"between": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 3 {
+				return nil, fmt.Errorf("between() accepts exactly three arguments")
+			}
+			var vs [3]float64
+			for i, arg := range args {
+				v, ok := toFloat(arg)
+				if !ok {
+					return nil, fmt.Errorf("between() accepts only numbers, got %v", arg)
+				}
+				vs[i] = v
+			}
+			return vs[1] <= vs[0] && vs[0] <= vs[2], nil
+		},
+		"state_in": func(args ...interface{}) (interface{}, error) {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("state_in() accepts at least one argument")
+			}
+			state, _ := args[0].(string)
+			for _, arg := range args[1:] {
+				name, ok := arg.(string)
+				if !ok {
+					return nil, fmt.Errorf("state_in() expects state names or classes, got %v", arg)
+				}
+				if stateIs(state, name) {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+		"duration_gt": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("duration_gt() accepts exactly one argument")
+			}
+			minutes, _ := toFloat(args[0])
+			s, ok := args[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("duration_gt() expects a duration such as \"30m\", got %v", args[1])
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("duration_gt() expects a duration such as \"30m\", got %q", s)
+			}
+			return minutes > d.Minutes(), nil
+		},
 	}
+
+	// stateInPattern and durationGtPattern match the calls of the functions
+	// passed the state and the duration of the goroutine, like has_tag().
+	stateInPattern    = regexp.MustCompile(`(^|[^\w.])state_in\s*\(`)
+	durationGtPattern = regexp.MustCompile(`(^|[^\w.])duration_gt\s*\(`)
 )
 
+// fuzzyContains tells if s contains a substring within maxdist edits
+// (insertions, deletions or substitutions) of sub.
+func fuzzyContains(s, sub string, maxdist int) bool {
+	p := []rune(sub)
+	if len(p) <= maxdist {
+		return true
+	}
+	// dist[j] is the least edits between p[:j] and a substring of s ending
+	// at the current rune.
+	dist := make([]int, len(p)+1)
+	for j := range dist {
+		dist[j] = j
+	}
+	for _, r := range s {
+		prev := dist[0] // dist[j-1] of the previous rune.
+		for j := 1; j <= len(p); j++ {
+			cur := dist[j]
+			d := prev
+			if p[j-1] != r {
+				d++
+			}
+			if dist[j]+1 < d {
+				d = dist[j] + 1
+			}
+			if dist[j-1]+1 < d {
+				d = dist[j-1] + 1
+			}
+			dist[j], prev = d, cur
+		}
+		if dist[len(p)] <= maxdist {
+			return true
+		}
+	}
+	return false
+}
+
+// frameArg returns the frame of the (trace, n) arguments of a conditional
+// function, the innermost one being 0, or nil if there are fewer frames.
+func frameArg(name string, args []interface{}) ([]string, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%s() accepts exactly two arguments", name)
+	}
+	trace, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s() expects a trace, got %v", name, args[0])
+	}
+	n, ok := toFloat(args[1])
+	if !ok {
+		return nil, fmt.Errorf("%s() expects a frame number, got %v", name, args[1])
+	}
+	frames := splitStack(trace).frames
+	if n < 0 || int(n) >= len(frames) {
+		return nil, nil
+	}
+	return frames[int(n)], nil
+}
+
+// toFloat converts a numeric argument of a conditional function to float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// equalValues compares two arguments of a conditional function, numerically
+// if both are numbers.
+func equalValues(a, b interface{}) bool {
+	x, ok1 := toFloat(a)
+	y, ok2 := toFloat(b)
+	if ok1 && ok2 {
+		return x == y
+	}
+	return a == b
+}
+
 // Goroutine contains a goroutine info.
 type Goroutine struct {
 	id       int
 	header   string
 	lines    int
+	frames   int
 	duration int // In minutes.
 	metas    map[MetaType]string
 
 	scrubbedHash string
-	fullHasher   hash.Hash
-	bufScrubbed  *bytes.Buffer
 	duplicates   []int
+	members      []*Goroutine // Goroutines deduped into this one, itself included.
+	count        int          // Aggregated goroutine count of debug=0 and debug=1 records.
+	tags         []string     // Labels set by tag(), shared by the dumps holding the goroutine.
+	notes        []string     // Free-text notes set by note(), shared like tags.
+	external     bool         // Without a Go stack, see isExternal.
+	contention   *Contention  // The contention hot spot it's blocked in, see CrossReference.
+	origin       string       // The dump it was merged from, see Merge.
+	explanation  string       // Set by explain(), see Explain.
 
 	frozen bool
 	buf    *bytes.Buffer
+	raw    []byte // The lines kept in the text of the dump until frozen, see addLine.
 }
 
-var lineWithArgs = regexp.MustCompile(`\((0x[0-9a-f ,]+)+\)$`)
+var (
+	// lineWithArgs matches the arguments of a call, which the runtime prints
+	// as words, such as "(0xc000010000, 0x1)", or since Go 1.17 with
+	// the structs in braces and the values maybe dead marked "?".
+	lineWithArgs = regexp.MustCompile(`\([0-9a-fx{}?, .]+\)$`)
+
+	// lineWithOffset matches the PC offset ending the location of a frame.
+	lineWithOffset = regexp.MustCompile(`^(\t.*:\d+) \+0x[0-9a-f]+$`)
+
+	// creatorGoroutine matches the id of the goroutine which created another,
+	// printed since Go 1.21.
+	creatorGoroutine = regexp.MustCompile(` in goroutine \d+$`)
+
+	// closureIndex matches the index the compiler numbers the closures of a
+	// function with, including those made for go and defer statements.
+	closureIndex = regexp.MustCompile(`\.(func|gowrap|deferwrap)\d+(\.\d+)*\b`)
+
+	// scrubClosures makes the closures of a function share their signature.
+	scrubClosures = false
+)
 
 // AddLine appends a line to the goroutine info.
 func (g *Goroutine) AddLine(l string) {
-	if !g.frozen {
-		g.lines++
+	g.addLine(l, nil)
+}
+
+// addLine appends a line read from a dump to the goroutine info. raw is the
+// line in the text of the dump, followed by "\n", or nil if it's not there as
+// is, e.g. for CRLF line endings. The trace is kept in the text of the dump
+// rather than copied, for as long as its lines follow one another there.
+func (g *Goroutine) addLine(l string, raw []byte) {
+	if g.frozen {
+		return
+	}
+	g.lines++
+	if isFrameLine(l) {
+		g.frames++
+	}
+
+	switch {
+	case raw != nil && g.raw == nil && g.buf.Len() == 0:
+		g.raw = raw
+	case raw != nil && g.raw != nil && follows(g.raw, raw):
+		g.raw = g.raw[:len(g.raw)+len(raw)]
+	default:
+		if g.raw != nil {
+			g.buf.Write(g.raw)
+			g.raw = nil
+		}
 		g.buf.WriteString(l + "\n")
+	}
+}
 
-		if lineWithArgs.MatchString(l) {
-			ss := lineWithArgs.Split(l, -1)
-			g.bufScrubbed.WriteString(ss[0] + "(...)\n")
-		} else {
-			g.bufScrubbed.WriteString(l + "\n")
+// follows tells if b starts right after a in the same array.
+func follows(a, b []byte) bool {
+	return len(b) > 0 && cap(a) > len(a) && &a[:len(a)+1][len(a)] == &b[0]
+}
+
+// scrub replaces the arguments of the calls in the trace by "...", so that
+// goroutines differing only by them share a signature.
+func scrub(trace string) string {
+	if trace == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.Grow(len(trace))
+	for _, l := range strings.Split(strings.TrimSuffix(trace, "\n"), "\n") {
+		if loc := lineWithArgs.FindStringIndex(l); loc != nil && !strings.HasPrefix(l, "\t") {
+			l = l[:loc[0]] + "(...)"
 		}
+		sb.WriteString(l)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
 
+// signature normalizes the scrubbed trace into the text the goroutines are
+// hashed by: the PC offsets in the functions and the id of the goroutine
+// creating them are dropped, and if scrubClosures is set, the closures of a
+// function are numbered "N", so that functionally identical stacks share it.
+// The blank lines trailing a trace, such as the separator before the next
+// goroutine of the dump, are dropped too.
+func signature(trace string) string {
+	if trace == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.Grow(len(trace))
+	for _, l := range strings.Split(strings.TrimRight(scrub(trace), "\n"), "\n") {
 		if strings.HasPrefix(l, "\t") {
-			parts := strings.Split(l, " ")
-			if len(parts) != 2 {
-				fmt.Println("ignored one line for digest")
-				return
+			if m := lineWithOffset.FindStringSubmatch(l); m != nil {
+				l = m[1]
+			}
+		} else {
+			if strings.HasPrefix(l, "created by ") {
+				l = creatorGoroutine.ReplaceAllString(l, "")
+			}
+			if scrubClosures {
+				l = closureIndex.ReplaceAllString(l, ".${1}N")
 			}
 		}
+		sb.WriteString(l)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// isFrameLine tells if l is the function line of a stack frame: either a
+// "#\t"-prefixed debug=1 frame or an unindented debug=2 call line.
+func isFrameLine(l string) bool {
+	if strings.HasPrefix(l, "#\t") {
+		return true
 	}
+	return l != "" && !strings.HasPrefix(l, "\t") && !strings.HasPrefix(l, "#") &&
+		!strings.HasPrefix(l, "created by ") && !strings.HasPrefix(l, "...")
+}
+
+// size estimates the number of bytes held by the goroutine info.
+func (g *Goroutine) size() int {
+	return int(unsafe.Sizeof(*g)) + len(g.header) + len(g.scrubbedHash) +
+		g.buf.Cap() + 8*cap(g.duplicates) + 8*cap(g.members)
 }
 
 // Freeze freezes the goroutine info.
 func (g *Goroutine) Freeze() {
 	if !g.frozen {
 		g.frozen = true
-		g.scrubbedHash = hex.EncodeToString(g.fullHasher.Sum(g.bufScrubbed.Bytes()))
+		if g.raw != nil {
+			// Capped, so that the text around isn't written over.
+			g.buf = bytes.NewBuffer(g.raw[:len(g.raw):len(g.raw)])
+			g.raw = nil
+		}
+		g.external = g.isExternal()
+		sum := md5.Sum([]byte(signature(g.buf.String())))
+		g.scrubbedHash = hex.EncodeToString(sum[:])
 	}
 }
 
+// isExternal tells if the goroutine has no Go stack trace: it runs on another
+// thread, typically in cgo, or it's the g0 of a thread, such as the signal
+// handler printing the dump.
+func (g *Goroutine) isExternal() bool {
+	if g.count > 0 {
+		return false
+	}
+	trace := g.buf.String()
+	return g.id == 0 || strings.Contains(trace, "stack unavailable") || strings.Contains(trace, "non-Go function")
+}
+
+// Dups returns the number of goroutines sharing the stack trace.
+func (g *Goroutine) Dups() int {
+	if g.count > 0 {
+		return g.count
+	}
+	return len(g.duplicates)
+}
+
 // Print outputs the goroutine details to w.
 func (g Goroutine) Print(w io.Writer) error {
-	if len(g.duplicates) > 1 {
+	if g.count > 0 {
+		fmt.Fprintln(w, g.aggregatedHeader())
+		fmt.Fprintln(w, g.buf.String())
+	} else if len(g.duplicates) > 1 {
 		fmt.Fprintf(w, "%s %d times: %v\n", scrubHeader(g.header), len(g.duplicates), g.duplicates)
-		fmt.Fprintln(w, g.bufScrubbed.String())
+		fmt.Fprintln(w, scrub(g.buf.String()))
 	} else {
 		fmt.Fprintf(w, "%s\n", g.header)
 		fmt.Fprintln(w, g.buf.String())
@@ -116,19 +460,99 @@ func (g Goroutine) Print(w io.Writer) error {
 
 // PrintWithColor outputs the goroutine details to stdout with color.
 func (g Goroutine) PrintWithColor() {
-	if len(g.duplicates) > 1 {
-		sgr.Printf("[fg-blue]%s[reset] [fg-red]%d[reset] times: [fg-green]%v[reset]\n", scrubHeader(g.header), len(g.duplicates), g.duplicates)
-		fmt.Println(g.bufScrubbed.String())
+	g.PrintWithHighlight(nil)
+}
+
+// PrintWithHighlight outputs the goroutine details to stdout with color, and
+// highlights the portions matching re if it's not nil.
+func (g Goroutine) PrintWithHighlight(re *regexp.Regexp) {
+	hl := func(s string) string {
+		if re == nil {
+			return s
+		}
+		return re.ReplaceAllStringFunc(s, func(m string) string {
+			return highlightStart + m + highlightEnd
+		})
+	}
+
+	trace := func(s string) string {
+		return hl(elideFrames(s, displayMaxFrames))
+	}
+
+	notes := func() {
+		if g.origin != "" {
+			sgr.Printf("[fg-magenta]# origin: %s[reset]\n", g.origin)
+		}
+		for _, n := range g.notes {
+			sgr.Printf("[fg-yellow]# %s[reset]\n", n)
+		}
+		if g.explanation != "" {
+			sgr.Printf("[fg-green]# explained: %s[reset]\n", g.explanation)
+		}
+		if c := g.contention; c != nil {
+			sgr.Printf("[fg-red]# contended: %s waited in %d events in %s[reset]\n", c.Delay.Round(time.Millisecond), c.Count, c.Function)
+		}
+	}
+
+	if g.count > 0 {
+		sgr.Printf("[fg-blue]%s[reset]\n", hl(g.aggregatedHeader()))
+		notes()
+		fmt.Println(trace(g.buf.String()))
+	} else if len(g.duplicates) > 1 {
+		sgr.Printf("[fg-blue]%s[reset] [fg-red]%d[reset] times: [fg-green]%v[reset]\n", hl(scrubHeader(g.header)), len(g.duplicates), g.duplicates)
+		notes()
+		fmt.Println(trace(scrub(g.buf.String())))
+		samples := sampleMembers(g.members, displaySamples)
+		for i, m := range samples {
+			sgr.Printf("[fg-cyan]%s[reset] (sample %d of %d, from %d)\n", hl(displayHeader(m.header)), i+1, len(samples), len(g.members))
+			fmt.Println(trace(m.buf.String()))
+		}
 	} else {
-		sgr.Printf("[fg-blue]%s[reset]\n", g.header)
-		fmt.Println(g.buf.String())
+		sgr.Printf("[fg-blue]%s[reset]\n", hl(displayHeader(g.header)))
+		notes()
+		fmt.Println(trace(g.buf.String()))
+	}
+}
+
+// PrintRaw outputs the original text of the goroutine to w.
+func (g Goroutine) PrintRaw(w io.Writer) error {
+	fmt.Fprintln(w, g.header)
+	fmt.Fprint(w, g.buf.String())
+	if !bytes.HasSuffix(g.buf.Bytes(), []byte("\n\n")) {
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// headerCount returns the count in the record line of a debug=1 record, zero
+// for other goroutines.
+func (g Goroutine) headerCount() int {
+	if g.count == 0 {
+		return 0
 	}
+	count, _ := strconv.Atoi(strings.TrimSpace(g.header[:strings.Index(g.header, "@")]))
+	return count
+}
+
+// aggregatedHeader returns the record line of a debug=1 record with the
+// current count, which changes when records are deduped.
+func (g Goroutine) aggregatedHeader() string {
+	idx := strings.Index(g.header, "@")
+	return fmt.Sprintf("%d %s", g.count, g.header[idx:])
 }
 
 // NewGoroutine creates and returns a new Goroutine.
 func NewGoroutine(metaline string) (*Goroutine, error) {
-	idx := strings.Index(metaline, "[")
-	parts := strings.Split(metaline[idx+1:len(metaline)-2], ",")
+	m := startLinePattern.FindStringSubmatch(metaline)
+	if m == nil {
+		return nil, fmt.Errorf("malformed goroutine header %q", metaline)
+	}
+	id, err := strconv.Atoi(m[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid goroutine id %s", m[1])
+	}
+
+	parts := strings.Split(m[2], ",")
 	metas := map[MetaType]string{
 		MetaState: strings.TrimSpace(parts[0]),
 	}
@@ -144,28 +568,69 @@ func NewGoroutine(metaline string) (*Goroutine, error) {
 		}
 	}
 
-	idstr := strings.TrimSpace(metaline[9:idx])
-	id, err := strconv.Atoi(idstr)
+	return &Goroutine{
+		id:         id,
+		lines:      1,
+		header:     metaline,
+		buf:        &bytes.Buffer{},
+		duration:   duration,
+		metas:      metas,
+		duplicates: []int{},
+	}, nil
+}
+
+// NewAggregatedGoroutine creates and returns a new Goroutine from the record
+// line "<count> @ <pc>..." of a debug=1 goroutine profile.
+func NewAggregatedGoroutine(recordline string) (*Goroutine, error) {
+	idx := strings.Index(recordline, "@")
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid profile record %q", recordline)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(recordline[:idx]))
 	if err != nil {
 		return nil, err
 	}
+	if count < 1 {
+		return nil, fmt.Errorf("invalid goroutine count in profile record %q", recordline)
+	}
 
 	return &Goroutine{
-		id:          id,
-		lines:       1,
-		header:      metaline,
-		buf:         &bytes.Buffer{},
-		bufScrubbed: &bytes.Buffer{},
-		duration:    duration,
-		metas:       metas,
-		fullHasher:  md5.New(),
-		duplicates:  []int{},
+		lines:  1,
+		header: recordline,
+		buf:    &bytes.Buffer{},
+		metas: map[MetaType]string{
+			MetaState: "unknown",
+		},
+		duplicates: []int{},
+		count:      count,
 	}, nil
 }
 
 // GoroutineDump defines a goroutine dump.
 type GoroutineDump struct {
 	goroutines []*Goroutine
+	parseTime  time.Duration
+	warnings   []ParseWarning
+	preamble   []string // Lines before the first goroutine, such as a panic message.
+	notes      []string // Free-text notes set by note().
+	threads    []string // Lines of the thread states, such as registers, after the goroutines.
+}
+
+// ParseWarning describes a problem found while loading a dump.
+type ParseWarning struct {
+	Line   int
+	Reason string
+}
+
+// DumpStats contains the statistics of a goroutine dump.
+type DumpStats struct {
+	ParseTime  time.Duration
+	Goroutines int
+	Signatures int
+	Frames     int
+	MaxDepth   int
+	MaxDepthID int
+	Bytes      int
 }
 
 // Add appends a goroutine info to the list.
@@ -174,9 +639,11 @@ func (gd *GoroutineDump) Add(g *Goroutine) {
 }
 
 // Copy duplicates and returns the GoroutineDump.
-func (gd GoroutineDump) Copy(cond string) *GoroutineDump {
+func (gd GoroutineDump) Copy(cond string) (*GoroutineDump, error) {
 	dump := GoroutineDump{
 		goroutines: []*Goroutine{},
+		preamble:   gd.preamble,
+		notes:      gd.notes[:len(gd.notes):len(gd.notes)],
 	}
 	if cond == "" {
 		// Copy all.
@@ -191,42 +658,88 @@ func (gd GoroutineDump) Copy(cond string) *GoroutineDump {
 			return nil
 		})
 		if err != nil {
-			fmt.Println(err)
-			return nil
+			return nil, err
 		}
 		dump.goroutines = goroutines
 	}
-	return &dump
+	return &dump, nil
 }
 
 // Dedup finds goroutines with duplicated stack traces and keeps only one copy
-// of them.
-func (gd *GoroutineDump) Dedupe() {
-	m := map[string][]int{}
+// of them, in the order they first appear. The duplicates stay reachable from
+// the copy kept. It returns the number of goroutines removed.
+func (gd *GoroutineDump) Dedupe() int {
+	groups := map[string]*Goroutine{}
+	kept := make([]*Goroutine, 0, len(gd.goroutines))
+
 	for _, g := range gd.goroutines {
-		m[g.scrubbedHash] = append(m[g.scrubbedHash], g.id)
+		rep, ok := groups[g.scrubbedHash]
+		if !ok {
+			// Copy the goroutine as it may be shared by other dumps.
+			c := *g
+			rep = &c
+			rep.duplicates = nil
+			rep.members = nil
+			rep.count = 0
+			groups[g.scrubbedHash] = rep
+			kept = append(kept, rep)
+		}
+
+		rep.count += g.count
+		if len(g.members) > 0 {
+			// Deduped before.
+			rep.duplicates = append(rep.duplicates, g.duplicates...)
+			rep.members = append(rep.members, g.members...)
+		} else {
+			rep.duplicates = append(rep.duplicates, g.id)
+			rep.members = append(rep.members, g)
+		}
 	}
 
-	kept := make([]*Goroutine, 0, len(gd.goroutines))
+	removed := len(gd.goroutines) - len(kept)
+	gd.goroutines = kept
+	return removed
+}
 
-	for digest, ids := range m {
-		for _, g := range gd.goroutines {
-			if g.scrubbedHash == digest {
-				g.duplicates = ids
-				kept = append(kept, g)
-				break
+// Find returns the goroutine with the id, including the duplicates removed by
+// dedupe, or nil if it's not in the dump.
+func (gd GoroutineDump) Find(id int) *Goroutine {
+	for _, g := range gd.goroutines {
+		if len(g.members) == 0 && g.id == id {
+			return g
+		}
+		for _, m := range g.members {
+			if m.id == id {
+				return m
 			}
 		}
 	}
+	return nil
+}
 
-	if len(gd.goroutines) != len(kept) {
-		fmt.Printf("dedupped %d, kept %d\n", len(gd.goroutines), len(kept))
-		gd.goroutines = kept
+// Partition splits the goroutines into those meeting the condition and the
+// others, evaluating it once.
+func (gd GoroutineDump) Partition(cond string) (*GoroutineDump, *GoroutineDump, error) {
+	notes := gd.notes[:len(gd.notes):len(gd.notes)]
+	matched := &GoroutineDump{goroutines: []*Goroutine{}, preamble: gd.preamble, notes: notes}
+	others := &GoroutineDump{goroutines: []*Goroutine{}, preamble: gd.preamble, notes: notes}
+	_, err := gd.withCondition(cond, func(i int, g *Goroutine, passed bool) *Goroutine {
+		if passed {
+			matched.goroutines = append(matched.goroutines, g)
+		} else {
+			others.goroutines = append(others.goroutines, g)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return matched, others, nil
 }
 
-// Delete deletes by the condition.
-func (gd *GoroutineDump) Delete(cond string) error {
+// Delete deletes by the condition. It returns the number of goroutines
+// deleted.
+func (gd *GoroutineDump) Delete(cond string) (int, error) {
 	goroutines, err := gd.withCondition(cond, func(i int, g *Goroutine, passed bool) *Goroutine {
 		if !passed {
 			return g
@@ -234,14 +747,19 @@ func (gd *GoroutineDump) Delete(cond string) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
+	deleted := len(gd.goroutines) - len(goroutines)
 	gd.goroutines = goroutines
-	return nil
+	return deleted, nil
 }
 
 // Diff shows the difference between two dumps.
 func (gd *GoroutineDump) Diff(another *GoroutineDump) (*GoroutineDump, *GoroutineDump, *GoroutineDump) {
+	if gd.deduped() || another.deduped() {
+		return gd.diffSignatures(another)
+	}
+
 	lonly := map[int]*Goroutine{}
 	ronly := map[int]*Goroutine{}
 	common := map[int]*Goroutine{}
@@ -260,8 +778,41 @@ func (gd *GoroutineDump) Diff(another *GoroutineDump) (*GoroutineDump, *Goroutin
 	return NewGoroutineDumpFromMap(lonly), NewGoroutineDumpFromMap(common), NewGoroutineDumpFromMap(ronly)
 }
 
-// Keep keeps by the condition.
-func (gd *GoroutineDump) Keep(cond string) error {
+// diffSignatures is Diff by stack signature, as the ids of deduped goroutines
+// don't match across dumps. The common goroutines are those of another, with
+// its group sizes.
+func (gd *GoroutineDump) diffSignatures(another *GoroutineDump) (*GoroutineDump, *GoroutineDump, *GoroutineDump) {
+	lcounts, _ := gd.countSignatures()
+	rcounts, _ := another.countSignatures()
+
+	lonly, common, ronly := NewGoroutineDump(), NewGoroutineDump(), NewGoroutineDump()
+	for _, g := range gd.goroutines {
+		if _, ok := rcounts[g.scrubbedHash]; !ok {
+			lonly.Add(g)
+		}
+	}
+	for _, g := range another.goroutines {
+		if _, ok := lcounts[g.scrubbedHash]; ok {
+			common.Add(g)
+		} else {
+			ronly.Add(g)
+		}
+	}
+	return lonly, common, ronly
+}
+
+// deduped tells if some goroutines of the dump have been deduped.
+func (gd *GoroutineDump) deduped() bool {
+	for _, g := range gd.goroutines {
+		if g.Dups() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Keep keeps by the condition. It returns the number of goroutines deleted.
+func (gd *GoroutineDump) Keep(cond string) (int, error) {
 	goroutines, err := gd.withCondition(cond, func(i int, g *Goroutine, passed bool) *Goroutine {
 		if passed {
 			return g
@@ -269,52 +820,180 @@ func (gd *GoroutineDump) Keep(cond string) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
+	deleted := len(gd.goroutines) - len(goroutines)
 	gd.goroutines = goroutines
-	return nil
+	return deleted, nil
 }
 
-// Save saves the goroutine dump to the given file.
-func (gd GoroutineDump) Save(fn string) error {
+// Save saves the goroutine dump to the given file, compressed if the file name
+// ends with ".gz" or ".zst". See Write for raw.
+func (gd GoroutineDump) Save(fn string, raw bool) error {
 	f, err := os.Create(fn)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	w, err := compress(f, fn)
+	if err != nil {
+		return err
+	}
+	if err := gd.Write(w, raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Write outputs the goroutine dump to w. If raw is true, the goroutines are
+// written with their original text and the lines preceding them in the dump
+// file, so that the output is a valid dump again, the deduped goroutines
+// included. Otherwise the deduped goroutines are written scrubbed, along with
+// the ids of their duplicates.
+func (gd GoroutineDump) Write(w io.Writer, raw bool) error {
+	if raw {
+		for _, l := range gd.preamble {
+			fmt.Fprintln(w, l)
+		}
+	}
+	if total := gd.aggregatedTotal(raw); total > 0 {
+		fmt.Fprintf(w, "goroutine profile: total %d\n", total)
+	}
 	for _, g := range gd.goroutines {
-		if err := g.Print(f); err != nil {
-			return err
+		if !raw {
+			if err := g.Print(w); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, m := range g.originals() {
+			if err := m.PrintRaw(w); err != nil {
+				return err
+			}
+		}
+	}
+	if raw {
+		for _, l := range gd.threads {
+			fmt.Fprintln(w, l)
 		}
 	}
 	return nil
 }
 
-// Search displays the goroutines with the offset and limit.
-func (gd GoroutineDump) Search(cond string, offset, limit int) {
-	sgr.Printf("[fg-green]Search with offset %d and limit %d.[reset]\n\n", offset, limit)
+// originals returns the goroutines deduped into g, or g itself.
+func (g *Goroutine) originals() []*Goroutine {
+	if len(g.members) > 0 {
+		return g.members
+	}
+	return []*Goroutine{g}
+}
+
+// sampleMembers picks n of the goroutines deduped into a group, spread evenly
+// over them, to tell how much their unscrubbed stacks differ.
+func sampleMembers(members []*Goroutine, n int) []*Goroutine {
+	if n >= len(members) {
+		return members
+	}
+	samples := make([]*Goroutine, n)
+	for i := range samples {
+		samples[i] = members[i*len(members)/n]
+	}
+	return samples
+}
 
+// aggregatedTotal returns the sum of the debug=1 record counts, zero if the
+// dump was not loaded from a goroutine profile. If raw is true, the counts
+// before dedupe are summed.
+func (gd GoroutineDump) aggregatedTotal(raw bool) int {
+	total := 0
+	for _, g := range gd.goroutines {
+		if raw {
+			for _, m := range g.originals() {
+				total += m.headerCount()
+			}
+		} else {
+			total += g.count
+		}
+	}
+	return total
+}
+
+// Search returns the goroutines meeting the condition within the offset and
+// limit, and the total number of goroutines meeting it.
+func (gd GoroutineDump) Search(cond string, offset, limit int) ([]*Goroutine, int, error) {
+	var found []*Goroutine
 	count := 0
 	_, err := gd.withCondition(cond, func(i int, g *Goroutine, passed bool) *Goroutine {
 		if passed {
 			if count >= offset && count < offset+limit {
-				g.PrintWithColor()
+				found = append(found, g)
 			}
 			count++
 		}
 		return nil
 	})
 	if err != nil {
-		fmt.Println(err)
+		return nil, 0, err
 	}
+	return found, count, nil
 }
 
-// Show displays the goroutines with the offset and limit.
-func (gd GoroutineDump) Show() {
-	for _, v := range gd.goroutines {
-		v.PrintWithColor()
+// Grep returns the goroutines whose header or stack trace matches re within
+// the offset and limit, and the total number of goroutines matching it.
+func (gd GoroutineDump) Grep(re *regexp.Regexp, offset, limit int) ([]*Goroutine, int) {
+	var found []*Goroutine
+	count := 0
+	for _, g := range gd.goroutines {
+		if !re.MatchString(g.header) && !re.Match(g.buf.Bytes()) {
+			continue
+		}
+		if count >= offset && count < offset+limit {
+			found = append(found, g)
+		}
+		count++
+	}
+	return found, count
+}
+
+// Count returns the number of goroutines, duplicates included, meeting the
+// condition or matching the search pattern, and the number in the dump.
+func (gd GoroutineDump) Count(arg string) (matched, total int, err error) {
+	var found []*Goroutine
+	if isCondition(arg) {
+		if found, _, err = gd.Search(arg, 0, len(gd.goroutines)); err != nil {
+			return 0, 0, err
+		}
+	} else {
+		found, _ = gd.Grep(compilePattern(arg), 0, len(gd.goroutines))
+	}
+	return weightOf(found), weightOf(gd.goroutines), nil
+}
+
+// weightOf returns the number of goroutines represented by gs.
+func weightOf(gs []*Goroutine) int {
+	n := 0
+	for _, g := range gs {
+		n += g.weight()
 	}
+	return n
+}
+
+func (gd *GoroutineDump) warn(line int, reason string) {
+	gd.warnings = append(gd.warnings, ParseWarning{Line: line, Reason: reason})
+}
+
+// Warnings returns the problems found while loading the dump.
+func (gd GoroutineDump) Warnings() []ParseWarning {
+	return gd.warnings
+}
+
+// Goroutines returns the goroutines of the dump.
+func (gd GoroutineDump) Goroutines() []*Goroutine {
+	return gd.goroutines
 }
 
 // Sort sorts the goroutine entries.
@@ -322,28 +1001,71 @@ func (gd *GoroutineDump) Sort() {
 	fmt.Printf("# of goroutines: %d\n", len(gd.goroutines))
 }
 
-// Summary prints the summary of the goroutine dump.
-func (gd GoroutineDump) Summary() {
-	fmt.Printf("# of goroutines: %d\n", len(gd.goroutines))
-	stats := map[string]int{}
-	if len(gd.goroutines) > 0 {
-		for _, g := range gd.goroutines {
-			stats[g.metas[MetaState]]++
+// Stats returns the statistics of the goroutine dump.
+func (gd GoroutineDump) Stats() DumpStats {
+	stats := DumpStats{
+		ParseTime:  gd.parseTime,
+		Goroutines: len(gd.goroutines),
+	}
+	signatures := map[string]struct{}{}
+	for _, g := range gd.goroutines {
+		signatures[g.scrubbedHash] = struct{}{}
+		stats.Frames += g.frames
+		stats.Bytes += g.size()
+		if len(g.members) > 1 {
+			// The first member shares its buffers with g.
+			for _, m := range g.members[1:] {
+				stats.Bytes += m.size()
+			}
+		}
+		if g.frames > stats.MaxDepth {
+			stats.MaxDepth = g.frames
+			stats.MaxDepthID = g.id
 		}
-		fmt.Println()
 	}
-	if len(stats) > 0 {
-		states := make([]string, 0, 10)
-		for k := range stats {
-			states = append(states, k)
+	stats.Signatures = len(signatures)
+	return stats
+}
+
+// Summary contains the number of goroutines in total, by state, by the
+// package they are blocked in and by the package which created them.
+type Summary struct {
+	Total    int
+	Longest  *Goroutine // The goroutine waiting the longest, if any waits.
+	States   map[string]int
+	Classes  map[string]int
+	Packages map[string]int
+	Creators map[string]int
+}
+
+// Summary returns the summary of the goroutine dump.
+func (gd GoroutineDump) Summary() Summary {
+	summary := Summary{
+		Total:    len(gd.goroutines),
+		States:   map[string]int{},
+		Classes:  map[string]int{},
+		Packages: map[string]int{},
+		Creators: map[string]int{},
+	}
+	for _, g := range gd.goroutines {
+		summary.States[g.metas[MetaState]]++
+		summary.Classes[stateClass(g.metas[MetaState])]++
+		if g.duration > 0 && (summary.Longest == nil || g.duration > summary.Longest.duration) {
+			summary.Longest = g
+		}
+		if g.external {
+			continue
 		}
-		sort.Sort(sort.StringSlice(states))
 
-		for _, k := range states {
-			fmt.Printf("%15s: %d\n", k, stats[k])
+		st := splitStack(g.buf.String())
+		if pkg := st.leafPackage(); pkg != "" {
+			summary.Packages[pkg]++
+		}
+		if pkg := st.creatorPackage(); pkg != "" {
+			summary.Creators[pkg]++
 		}
-		fmt.Println()
 	}
+	return summary
 }
 
 // NewGoroutineDump creates and returns a new GoroutineDump.
@@ -365,36 +1087,203 @@ func NewGoroutineDumpFromMap(gs map[int]*Goroutine) *GoroutineDump {
 }
 
 func (gd *GoroutineDump) withCondition(cond string, callback func(int, *Goroutine, bool) *Goroutine) ([]*Goroutine, error) {
-	cond = strings.Trim(cond, "\"")
+	cond, err := prepareCondition(cond)
+	if err != nil {
+		return nil, err
+	}
 	expression, err := govaluate.NewEvaluableExpressionWithFunctions(cond, functions)
 	if err != nil {
 		return nil, err
 	}
 
+	passed, err := gd.evaluate(statementCtx, expression)
+	if err != nil {
+		return nil, err
+	}
+
 	goroutines := make([]*Goroutine, 0, len(gd.goroutines))
 	for i, g := range gd.goroutines {
-		params := map[string]interface{}{
-			"id":       g.id,
-			"dups":     len(g.duplicates),
-			"duration": g.duration,
-			"lines":    g.lines,
-			"state":    g.metas[MetaState],
-			"trace":    g.buf.String(),
-		}
-		res, err := expression.Evaluate(params)
+		if gor := callback(i, g, passed[i]); gor != nil {
+			goroutines = append(goroutines, gor)
+		}
+	}
+	return goroutines, nil
+}
+
+// minParallel is the number of goroutines from which conditions are evaluated
+// by several workers.
+const minParallel = 1000
+
+// interruptCheck is the number of goroutines a condition is evaluated over
+// between two checks of whether the statement was interrupted.
+const interruptCheck = 256
+
+var errInterrupted = errors.New("interrupted")
+
+// evaluate evaluates the expression over each goroutine. Large dumps are split
+// into contiguous chunks evaluated in parallel. Only the properties referenced
+// by the expression are passed, as getting the trace copies the whole text.
+// The evaluation stops once ctx is done.
+func (gd *GoroutineDump) evaluate(ctx context.Context, expression *govaluate.EvaluableExpression) ([]bool, error) {
+	fields := map[string]func(g *Goroutine) interface{}{}
+	for _, v := range expression.Vars() {
+		if field, ok := conditionFields[v]; ok {
+			fields[v] = field
+		}
+	}
+
+	passed := make([]bool, len(gd.goroutines))
+	eval := func(from, to int) error {
+		params := make(map[string]interface{}, len(fields))
+		for i := from; i < to; i++ {
+			if (i-from)%interruptCheck == 0 && ctx.Err() != nil {
+				return errInterrupted
+			}
+			g := gd.goroutines[i]
+			for k, field := range fields {
+				params[k] = field(g)
+			}
+			res, err := expression.Evaluate(params)
+			if err != nil {
+				return err
+			}
+			val, ok := res.(bool)
+			if !ok {
+				return errors.New("argument expression should return a boolean")
+			}
+			passed[i] = val
+		}
+		return nil
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if len(gd.goroutines) < minParallel || workers == 1 {
+		return passed, eval(0, len(gd.goroutines))
+	}
+
+	chunk := (len(gd.goroutines) + workers - 1) / workers
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		from, to := w*chunk, (w+1)*chunk
+		if to > len(gd.goroutines) {
+			to = len(gd.goroutines)
+		}
+		if from >= to {
+			break
+		}
+		wg.Add(1)
+		go func(w, from, to int) {
+			defer wg.Done()
+			errs[w] = eval(from, to)
+		}(w, from, to)
+	}
+	wg.Wait()
+
+	// Report the error of the first goroutine failing, as a sequential
+	// evaluation would.
+	for _, err := range errs {
 		if err != nil {
 			return nil, err
 		}
-		if val, ok := res.(bool); ok {
-			if gor := callback(i, g, val); gor != nil {
-				goroutines = append(goroutines, gor)
+	}
+	return passed, nil
+}
+
+// compilePattern compiles the search pattern, a quoted regular expression or a
+// plain substring if it's not a valid regular expression.
+func compilePattern(pattern string) *regexp.Regexp {
+	if p, err := strconv.Unquote(pattern); err == nil {
+		pattern = p
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		re = regexp.MustCompile(regexp.QuoteMeta(pattern))
+	}
+	return re
+}
+
+// prepareCondition expands the named filters of the condition, and passes the
+// tags of the goroutine to has_tag(), which is given the tag name only, and so
+// its state and duration to state_in() and duration_gt().
+func prepareCondition(cond string) (string, error) {
+	cond, err := expandFilters(strings.Trim(cond, "\""))
+	if err != nil {
+		return "", err
+	}
+	cond = stateInPattern.ReplaceAllString(cond, "${1}state_in(state, ")
+	cond = durationGtPattern.ReplaceAllString(cond, "${1}duration_gt(duration, ")
+	return hasTagPattern.ReplaceAllString(cond, "${1}has_tag(tags, "), nil
+}
+
+// isCondition tells if s is a conditional over the goroutine properties,
+// rather than a search pattern.
+func isCondition(s string) bool {
+	cond, err := prepareCondition(s)
+	if err != nil {
+		return false
+	}
+	expression, err := govaluate.NewEvaluableExpressionWithFunctions(cond, functions)
+	if err != nil {
+		return false
+	}
+	for _, v := range expression.Vars() {
+		if _, ok := conditionFields[v]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCondition parses the condition and evaluates it once over a sample
+// goroutine, to report unknown fields, syntax and type errors without going
+// over a dump. It returns the fields the condition uses.
+func checkCondition(cond string) ([]string, error) {
+	prepared, err := prepareCondition(cond)
+	if err != nil {
+		return nil, err
+	}
+	expression, err := govaluate.NewEvaluableExpressionWithFunctions(prepared, functions)
+	if err != nil {
+		return nil, err
+	}
+
+	var vars []string
+	params := map[string]interface{}{}
+	sample := sampleGoroutine()
+	for _, v := range expression.Vars() {
+		field, ok := conditionFields[v]
+		if !ok {
+			names := make([]string, 0, len(conditionFields))
+			for k := range conditionFields {
+				names = append(names, k)
 			}
-		} else {
-			return nil, errors.New("argument expression should return a boolean")
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown field %s, expect one of %s", v, strings.Join(names, ", "))
+		}
+		if _, ok := params[v]; !ok {
+			vars = append(vars, v)
+			params[v] = field(sample)
 		}
 	}
-	fmt.Printf("Deleted %d goroutines, kept %d.\n", len(gd.goroutines)-len(goroutines), len(goroutines))
-	return goroutines, nil
+
+	res, err := expression.Evaluate(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := res.(bool); !ok {
+		return nil, fmt.Errorf("the condition returns %v, not a boolean", res)
+	}
+	sort.Strings(vars)
+	return vars, nil
+}
+
+func sampleGoroutine() *Goroutine {
+	g, _ := NewGoroutine("goroutine 1 [chan receive, 5 minutes]:")
+	g.AddLine("main.main()")
+	g.AddLine("\t/app/main.go:10 +0x1d")
+	g.Freeze()
+	return g
 }
 
 func scrubHeader(s string) string {
@@ -1,6 +1,24 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
 
 func Test_Dedupe(t *testing.T) {
 	d, err := load("samples/stack2.txt")
@@ -8,5 +26,1684 @@ func Test_Dedupe(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	if removed := d.Dedupe(); removed != 6 {
+		t.Errorf("expect 6 goroutines removed, got %d", removed)
+	}
+	if summary := d.Summary(); summary.Total != 4 || summary.States["chan receive"] != 1 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
+
+func Test_LoadProfiles(t *testing.T) {
+	for _, fn := range []string{"samples/profile0.pb.gz", "samples/profile1.txt"} {
+		d, err := load(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		total := 0
+		for _, g := range d.goroutines {
+			total += g.Dups()
+		}
+		if total != 10 {
+			t.Errorf("%s: expect 10 goroutines, got %d", fn, total)
+		}
+	}
+}
+
+func Test_TruncateStrip(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := d.Strip("internal/sync"); err != nil || n != 3 {
+		t.Errorf("expect 3 goroutines stripped, got %d, %v", n, err)
+	}
+	d.Truncate(1)
+	for _, g := range d.goroutines {
+		if g.frames > 1 {
+			t.Errorf("goroutine %d has %d frames after truncate", g.id, g.frames)
+		}
+	}
+	d.Dedupe()
+	if len(d.goroutines) != 4 {
+		t.Errorf("expect 4 goroutines after dedupe, got %d", len(d.goroutines))
+	}
+
+	workspace["t"] = d
+	defer delete(workspace, "t")
+	for _, stmt := range []string{"t.truncate(-1)", "t.truncate(\"1\")", "t.truncate(depth)"} {
+		if err := expr(stmt); err == nil {
+			t.Errorf("%s: expect an error", stmt)
+		}
+	}
+}
+
+func Test_MalformedHeaders(t *testing.T) {
+	d, err := parse(strings.NewReader(`goroutine 1 [running]:
+main.main()
+	/app/main.go:10 +0x1d
+
+goroutine x [select]:
+main.loop()
+	/app/main.go:20 +0x2a
+
+goroutine 3 [chan receive:
+main.worker()
+	/app/main.go:30 +0x3b
+
+goroutine 5 gp=0xc000007340 m=nil [chan receive]:
+main.worker()
+	/app/main.go:30 +0x3b
+
+goroutine 4 [sleep]:
+time.Sleep(0x3b9aca00)
+	/usr/local/go/src/runtime/time.go:195 +0x125
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.goroutines) != 3 || d.goroutines[0].lines != 4 {
+		t.Errorf("expect goroutines 1, 5 and 4 to be kept intact, got %d", len(d.goroutines))
+	}
+	warnings := d.Warnings()
+	if len(warnings) != 2 || warnings[0].Line != 5 || warnings[1].Line != 9 {
+		t.Errorf("unexpected warnings %+v", warnings)
+	}
+}
+
+func Test_SaveCompressed(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range []string{".gz", ".zst"} {
+		fn := filepath.Join(t.TempDir(), "dump"+ext)
+		if err := d.Save(fn, false); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := load(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded.goroutines) != len(d.goroutines) {
+			t.Errorf("%s: expect %d goroutines, got %d", ext, len(d.goroutines), len(loaded.goroutines))
+		}
+	}
+}
+
+func Test_PkgName(t *testing.T) {
+	for l, want := range map[string]string{
+		"google.golang.org/grpc/transport.(*http2Server).keepalive(0xc420e59ce0)": "google.golang.org/grpc/transport",
+		"main.worker(...)": "main",
+		"created by net/http.(*Server).Serve in goroutine 1":          "net/http",
+		"#\t0x4dea98\tgopkg.in/yaml%2ev2.parse+0x18\t/app/main.go:10": "gopkg.in/yaml%2ev2",
+	} {
+		if got := pkgName(funcName(l)); got != want {
+			t.Errorf("pkgName(funcName(%q)) = %q, want %q", l, got, want)
+		}
+	}
+}
+
+func Test_SaveRaw(t *testing.T) {
+	for _, fn := range []string{"samples/stack2.txt", "samples/profile1.txt"} {
+		d, err := load(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := d.Write(&buf, true); err != nil {
+			t.Fatal(err)
+		}
+		original, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimRight(buf.String(), "\n") != strings.TrimRight(string(original), "\n") {
+			t.Errorf("%s: raw output differs from the original:\n%s", fn, buf.String())
+		}
+	}
+}
+
+func Test_DedupeKeepsDuplicates(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Copy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Dedupe()
+	c.Dedupe()
+	if g := c.Find(9); g == nil || g.id != 9 || len(g.duplicates) != 0 {
+		t.Errorf("expect goroutine 9 intact after dedupe, got %+v", g)
+	}
+	if g := c.goroutines[1]; g.Dups() != 5 {
+		t.Errorf("expect 5 duplicates of goroutine %d, got %d", g.id, g.Dups())
+	}
+	for _, g := range d.goroutines {
+		if len(g.duplicates) != 0 {
+			t.Errorf("goroutine %d of the original dump changed by dedupe", g.id)
+		}
+	}
+}
+
+func Test_ParallelCondition(t *testing.T) {
+	var sb strings.Builder
+	for i := 1; i <= 3*minParallel; i++ {
+		fmt.Fprintf(&sb, "goroutine %d [select, %d minutes]:\nmain.worker()\n\t/app/main.go:10\n\n", i, i%7)
+	}
+	d, err := parse(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := d.Keep("duration == 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 3*minParallel-len(d.goroutines) {
+		t.Errorf("expect %d deleted, got %d", 3*minParallel-len(d.goroutines), deleted)
+	}
+	for i, g := range d.goroutines {
+		if g.id != 7*i+3 {
+			t.Fatalf("expect goroutine %d at %d, got %d", 7*i+3, i, g.id)
+		}
+	}
+}
+
+func Test_Tags(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.Tag("duration > 1", "old"); err != nil || n != 2 {
+		t.Fatalf("expect 2 goroutines tagged, got %d, %v", n, err)
+	}
+	if n, err := d.Tag("id == 6", "old"); err != nil || n != 0 {
+		t.Errorf("expect no goroutine tagged twice, got %d, %v", n, err)
+	}
+
+	c, err := d.Copy("has_tag('old') && id != 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.goroutines) != 1 || c.goroutines[0].id != 6 {
+		t.Errorf("expect goroutine 6 copied by tag, got %d goroutines", len(c.goroutines))
+	}
+	if found := d.Tagged("old"); len(found) != 2 {
+		t.Errorf("expect 2 goroutines tagged old, got %d", len(found))
+	}
+}
+
+func Test_SavePprof(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Dedupe()
+
+	fn := filepath.Join(t.TempDir(), "goroutines.pb.gz")
+	if err := d.SavePprof(fn); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := loaded.aggregatedTotal(false); total != 10 {
+		t.Errorf("expect 10 goroutines in the profile, got %d", total)
+	}
+	if !strings.Contains(loaded.goroutines[1].buf.String(), "main.worker") {
+		t.Errorf("expect main.worker in the profile, got %s", loaded.goroutines[1].buf.String())
+	}
+}
+
+func Test_FuzzyContains(t *testing.T) {
+	for _, c := range []struct {
+		s, sub  string
+		maxdist int
+		want    bool
+	}{
+		{"main.(*Broker).Subscribe(0xc42)", "(*Broker).Subscribe", 0, true},
+		{"main.(*Broker).Subscribe(0xc42)", "(*Broker).Subscrbe", 0, false},
+		{"main.(*Broker).Subscribe(0xc42)", "(*Broker).Subscrbe", 1, true},
+		{"main.(*Broker).Subscribe(0xc42)", "(*Brokre).Subscirbe", 2, false},
+		{"main.(*Broker).Subscribe(0xc42)", "(*Brokre).Subscirbe", 4, true},
+		{"", "ab", 2, true},
+	} {
+		if got := fuzzyContains(c.s, c.sub, c.maxdist); got != c.want {
+			t.Errorf("fuzzyContains(%q, %q, %d) = %v, expect %v", c.s, c.sub, c.maxdist, got, c.want)
+		}
+	}
+}
+
+func Test_StateClass(t *testing.T) {
+	for state, want := range map[string]string{
+		"semacquire":              "blocked-lock",
+		"sync.Mutex.Lock":         "blocked-lock",
+		"sync.WaitGroup.Wait":     "blocked-lock",
+		"chan receive (nil chan)": "blocked-chan",
+		"select":                  "blocked-chan",
+		"IO wait":                 "blocked-io",
+		"GC worker (idle)":        "GC",
+		"sleep":                   "sleeping",
+		"unknown":                 "unknown",
+		"trace reader (blocked)":  "other",
+	} {
+		if got := stateClass(state); got != want {
+			t.Errorf("stateClass(%q) = %s, expect %s", state, got, want)
+		}
+	}
+}
+
+func Test_Archive(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Dedupe()
+	if _, err := d.Tag("id == 11", "lock"); err != nil {
+		t.Fatal(err)
+	}
+	workspace = map[string]*GoroutineDump{"x": d}
+	defer func() { workspace = map[string]*GoroutineDump{} }()
+
+	fn := filepath.Join(t.TempDir(), "analysis.zip")
+	if err := archive(fn); err != nil {
+		t.Fatal(err)
+	}
+	workspace = map[string]*GoroutineDump{}
+	if _, err := unarchive(fn); err != nil {
+		t.Fatal(err)
+	}
+	x, ok := workspace["x"]
+	if !ok || len(x.goroutines) != len(d.goroutines) {
+		t.Fatalf("expect x restored with %d goroutines, got %v", len(d.goroutines), x)
+	}
+	if found := x.Tagged("lock"); len(found) != 1 || found[0].id != 11 || found[0].Dups() != 3 {
+		t.Errorf("expect the deduped goroutine 11 tagged, got %+v", found[0])
+	}
+}
+
+func Test_LoadCRLF(t *testing.T) {
+	for _, fn := range []string{"samples/stack2.txt", "samples/profile1.txt"} {
+		original, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := parse(bytes.NewReader(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		crlf := append([]byte("\xef\xbb\xbf"), bytes.ReplaceAll(original, []byte("\n"), []byte("\r\n"))...)
+		d, err := parse(bytes.NewReader(crlf))
+		if err != nil {
+			t.Fatalf("%s: %s", fn, err)
+		}
+		if len(d.goroutines) != len(want.goroutines) || len(d.warnings) != 0 {
+			t.Fatalf("%s: expect %d goroutines without warnings, got %d and %v", fn, len(want.goroutines), len(d.goroutines), d.warnings)
+		}
+		for i, g := range d.goroutines {
+			if g.header != want.goroutines[i].header || g.buf.String() != want.goroutines[i].buf.String() {
+				t.Errorf("%s: goroutine %d differs:\n%s%s", fn, i, g.header, g.buf.String())
+			}
+		}
+	}
+}
+
+func Test_ExternalStacks(t *testing.T) {
+	d, err := parse(strings.NewReader(`SIGQUIT: quit
+PC=0x40c84e m=0 sigcode=0
+
+goroutine 0 gp=0x531440 m=0 mp=0x532200 [idle]:
+internal/runtime/syscall/linux.Syscall6()
+	/usr/local/go/src/internal/runtime/syscall/linux/asm_linux_amd64.s:36 +0xe
+
+goroutine 1 [running]:
+	goroutine running on other thread; stack unavailable
+
+goroutine 7 [sleep]:
+time.Sleep(0x34630b8a000)
+	/usr/local/go/src/runtime/time.go:368 +0x165
+main.main.func1()
+	/app/main.go:3 +0x1d
+
+rax    0xfffffffffffffffc
+rip    0x40c84e
+rflags 0x246
+gs     0x0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.goroutines) != 3 || len(d.threads) != 4 {
+		t.Fatalf("expect 3 goroutines and 4 thread lines, got %d and %q", len(d.goroutines), d.threads)
+	}
+	for i, want := range []bool{true, true, false} {
+		if d.goroutines[i].external != want {
+			t.Errorf("expect goroutine %d external %v", d.goroutines[i].id, want)
+		}
+	}
+	if g := d.goroutines[2]; g.frames != 2 || strings.Contains(g.buf.String(), "rax") {
+		t.Errorf("expect the registers out of goroutine 7, got %d frames:\n%s", g.frames, g.buf.String())
+	}
+	if n := d.Truncate(0); n != 1 {
+		t.Errorf("expect only goroutine 7 truncated, got %d", n)
+	}
+}
+
+func Test_LoadTruncated(t *testing.T) {
+	d, err := parse(strings.NewReader(`goroutine 1 [running]:
+main.main()
+	/app/main.go:10 +0x1d
+
+goroutine 2 [select]:
+main.loop()
+	/app/main.go:20 +0x2a
+created by main.main
+	/app/main.go:12 +0x40
+
+goroutine 3 [chan rece
+	/app/main.go:30 +0x3b
+
+goroutine 4 [sleep]:
+time.Sleep(0x3b9aca00)
+	/usr/local/go/src/runtime/time.go:195 +0x125
+main.sleeper()
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.goroutines) != 3 || d.goroutines[1].lines != 6 {
+		t.Fatalf("expect goroutines 1, 2 and 4 with 2 intact, got %d", len(d.goroutines))
+	}
+	warnings := d.Warnings()
+	if len(warnings) != 2 || warnings[0].Line != 11 || warnings[1].Line != 14 {
+		t.Errorf("unexpected warnings %+v", warnings)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, fn := range []string{"samples/stack2.txt", "samples/profile1.txt"} {
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+		f.Add(b[:len(b)/2])
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		d, err := parse(bytes.NewReader(b))
+		if err != nil || isBinary(b) {
+			return
+		}
+		// What was kept of a text dump must survive a round trip through
+		// the raw format.
+		var buf bytes.Buffer
+		if err := d.Write(&buf, true); err != nil {
+			t.Fatal(err)
+		}
+		again, err := parse(&buf)
+		if err != nil {
+			t.Fatalf("can't parse the dump written back: %s", err)
+		}
+		if len(again.goroutines) != len(d.goroutines) {
+			t.Errorf("expect %d goroutines after a round trip, got %d", len(d.goroutines), len(again.goroutines))
+		}
+	})
+}
+
+func Test_SampleMembers(t *testing.T) {
+	members := make([]*Goroutine, 10)
+	for i := range members {
+		members[i] = &Goroutine{id: i}
+	}
+	var ids []int
+	for _, g := range sampleMembers(members, 3) {
+		ids = append(ids, g.id)
+	}
+	if fmt.Sprint(ids) != "[0 3 6]" {
+		t.Errorf("expect members 0, 3 and 6 sampled, got %v", ids)
+	}
+	if n := len(sampleMembers(members, 20)); n != 10 {
+		t.Errorf("expect all 10 members sampled, got %d", n)
+	}
+	if n := len(sampleMembers(members, 0)); n != 0 {
+		t.Errorf("expect no members sampled, got %d", n)
+	}
+}
+
+func Test_Track(t *testing.T) {
+	var dumps []*GoroutineDump
+	for _, trace := range []string{
+		"goroutine 5 [chan receive, 2 minutes]:\nmain.worker()\n\t/app/main.go:10 +0x1d\n",
+		"goroutine 5 [chan receive, 3 minutes]:\nmain.worker()\n\t/app/main.go:10 +0x1d\n",
+		"goroutine 6 [running]:\nmain.main()\n\t/app/main.go:3 +0x1d\n",
+		"goroutine 5 [select]:\nmain.loop()\n\t/app/main.go:20 +0x2a\n",
+	} {
+		d, err := parse(strings.NewReader(trace))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dumps = append(dumps, d)
+	}
+
+	points := Track(dumps, 5)
+	want := []TrackPoint{
+		{Found: true, State: "chan receive", Duration: 2, Frame: "main.worker"},
+		{Found: true, State: "chan receive", Duration: 3, Frame: "main.worker"},
+		{},
+		{Found: true, State: "select", Frame: "main.loop", Changed: true, Rewound: true},
+	}
+	for i, p := range points {
+		if p != want[i] {
+			t.Errorf("dump %d: expect %+v, got %+v", i, want[i], p)
+		}
+	}
+}
+
+func Test_DisplayDurations(t *testing.T) {
+	for minutes, want := range map[int]string{0: "0m", 12: "12m", 60: "1h", 92: "1h32m", 1500: "1d1h"} {
+		if got := formatMinutes(minutes); got != want {
+			t.Errorf("expect %d minutes as %s, got %s", minutes, want, got)
+		}
+	}
+
+	defer func() { captureTime = time.Time{} }()
+	if err := setCaptureTime("2026-10-14 10:05"); err != nil {
+		t.Fatal(err)
+	}
+	header := displayHeader("goroutine 6 [chan receive, 92 minutes, locked to thread]:")
+	if want := "goroutine 6 [chan receive, 1h32m since ~08:33, locked to thread]:"; header != want {
+		t.Errorf("expect %q, got %q", want, header)
+	}
+}
+
+func Test_CheckCondition(t *testing.T) {
+	vars, err := checkCondition(`"duration > 5 && state == 'select' && has_tag('x')"`)
+	if err != nil || fmt.Sprint(vars) != "[duration state tags]" {
+		t.Errorf("expect a valid condition over duration, state and tags, got %v, %v", vars, err)
+	}
+	for _, cond := range []string{"idd > 3", "id + 1", "state > 3", "id >"} {
+		if _, err := checkCondition(cond); err == nil {
+			t.Errorf("expect %q to be rejected", cond)
+		}
+	}
+}
+
+func Test_InBetween(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		cond string
+		want int
+	}{
+		{"in(id, 1, 7, 42)", 2},
+		{"in(state, 'select', 'chan receive')", 5},
+		{"in(id, '1')", 0},
+		{"between(duration, 3, 12)", 2}, // Inclusive.
+		{"between(duration, 4, 11)", 0},
+		{"between(id, 10, 12)", 3},
+		{"between(id, 12, 10)", 0},
+	} {
+		if _, n, err := d.Search(tc.cond, 0, 0); err != nil || n != tc.want {
+			t.Errorf("%s: expect %d goroutines, got %d, %v", tc.cond, tc.want, n, err)
+		}
+	}
+	for _, cond := range []string{"in(id)", "between(id, 1)", "between(id, 1, 2, 3)", "between(state, 1, 2)", "between(id, 'a', 2)"} {
+		if _, _, err := d.Search(cond, 0, 0); err == nil {
+			t.Errorf("%s: expect an error", cond)
+		}
+	}
+}
+
+func Test_FileLine(t *testing.T) {
+	const dump = `goroutine 1 [running]:
+main.inner(...)
+	/app/inner.go:5
+main.outer(0x1)
+	/app/outer.go:12 +0x25
+...additional frames elided...
+created by main.main in goroutine 1
+	/app/main.go:30 +0x37
+`
+	d, err := parse(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := load("samples/profile1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		d    *GoroutineDump
+		cond string
+		want int
+	}{
+		{d, "file(trace, 0) == '/app/inner.go' && line(trace, 0) == 5", 1}, // Inlined.
+		{d, "file(trace, 1) == '/app/outer.go' && line(trace, 1) == 12", 1},
+		// Neither the elided frames nor the creator count.
+		{d, "file(trace, 2) == '' && line(trace, 2) == 0", 1},
+		{d, "file(trace, -1) == '' && line(trace, -1) == 0", 1},
+		{profile, "file(trace, 0) == '/home/user/app/main.go' && line(trace, 0) == 10", 1},
+		{profile, "line(trace, 4) == 12", 1},
+	} {
+		if _, n, err := tc.d.Search(tc.cond, 0, 0); err != nil || n != tc.want {
+			t.Errorf("%s: expect %d goroutines, got %d, %v", tc.cond, tc.want, n, err)
+		}
+	}
+	for _, cond := range []string{"file(trace) == ''", "line(id, 0) == 1", "file(trace, 'x') == ''"} {
+		if _, _, err := d.Search(cond, 0, 0); err == nil {
+			t.Errorf("%s: expect an error", cond)
+		}
+	}
+}
+
+func Test_Undo(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspace["t"] = d
+	defer func() {
+		delete(workspace, "t")
+		undoStack, redoStack = nil, nil
+	}()
+
+	before := d.snapshot()
 	d.Dedupe()
+	journal("t", "t.dedupe()", d, before)
+	before = d.snapshot()
+	d.Truncate(0)
+	journal("t", "t.truncate(0)", d, before)
+	if err := undo(false); err != nil || len(d.goroutines) != 4 || d.goroutines[0].frames == 0 {
+		t.Fatalf("expect the deduped goroutines back with their frames, got %d, %v", len(d.goroutines), err)
+	}
+	if err := undo(false); err != nil || len(d.goroutines) != 10 {
+		t.Fatalf("expect the 10 goroutines back, got %d, %v", len(d.goroutines), err)
+	}
+	if err := undo(true); err != nil || len(d.goroutines) != 4 {
+		t.Fatalf("expect the dedupe redone, got %d, %v", len(d.goroutines), err)
+	}
+
+	before = d.snapshot()
+	d.Delete("id > 100")
+	journal("t", `t.delete("id > 100")`, d, before)
+	if err := undo(false); err != nil || len(d.goroutines) != 10 {
+		t.Errorf("expect the delete deleting nothing skipped, got %d, %v", len(d.goroutines), err)
+	}
+
+	before = d.snapshot()
+	d.Delete("id > 8")
+	journal("t", `t.delete("id > 8")`, d, before)
+	if err := undo(true); err == nil {
+		t.Errorf("expect nothing to redo after a change")
+	}
+}
+
+func Test_Symbolize(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSymbolizer(exe)
+	if err != nil {
+		// go test strips the debug info, unless the test binary is built
+		// with go test -c first.
+		t.Skipf("no debug info in the test binary: %s", err)
+	}
+
+	pc := reflect.ValueOf(formatMinutes).Pointer()
+	g, err := NewAggregatedGoroutine(fmt.Sprintf("1 @ %#x", pc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.AddLine(fmt.Sprintf("#\t%#x", pc))
+	g.Freeze()
+	d := &GoroutineDump{goroutines: []*Goroutine{g}}
+
+	if n := d.Symbolize(s); n != 1 {
+		t.Fatalf("expect 1 goroutine symbolized, got %d", n)
+	}
+	if trace := d.goroutines[0].buf.String(); !strings.Contains(trace, ".formatMinutes+0x0\t") || !strings.Contains(trace, "duration.go:") {
+		t.Errorf("expect formatMinutes in duration.go, got %q", trace)
+	}
+	if g.buf.Len() == d.goroutines[0].buf.Len() {
+		t.Errorf("expect the original goroutine untouched")
+	}
+}
+
+// callerPC returns the return address into its caller.
+//
+//go:noinline
+func callerPC() uintptr {
+	pcs := make([]uintptr, 1)
+	runtime.Callers(2, pcs)
+	return pcs[0]
+}
+
+// inlinedCallerPC is inlined into its callers, so the address callerPC
+// returns is in the code inlined.
+func inlinedCallerPC() uintptr {
+	return callerPC()
+}
+
+func Test_SymbolizeInlined(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSymbolizer(exe)
+	if err != nil {
+		t.Skipf("no debug info in the test binary: %s", err)
+	}
+
+	// A stack printed without the frames of the inlined functions. Package
+	// main is named by its import path in a test binary.
+	entry := reflect.ValueOf(Test_SymbolizeInlined).Pointer()
+	offset := inlinedCallerPC() - entry
+	test := runtime.FuncForPC(entry).Name()
+	inlined := strings.TrimSuffix(test, "Test_SymbolizeInlined") + "inlinedCallerPC"
+	d, err := parse(strings.NewReader(fmt.Sprintf(`goroutine 1 [running]:
+main.nowhere()
+	/app/main.go:10 +0x10
+%s(0xc000102000)
+	/app/inspect_test.go:1 +%#x
+`, test, offset)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := d.Symbolize(s); n != 1 {
+		t.Fatalf("expect 1 goroutine symbolized, got %d", n)
+	}
+	want := regexp.MustCompile(`\n` + regexp.QuoteMeta(inlined+"(...)") + `\n\t.*inspect_test\.go:\d+\n` +
+		regexp.QuoteMeta(test+"(0xc000102000)") + `\n\t.*inspect_test\.go:\d+ \+0x`)
+	if trace := d.goroutines[0].buf.String(); !want.MatchString(trace) || strings.Contains(trace, "inspect_test.go:1 ") {
+		t.Errorf("expect the frame of inlinedCallerPC added, got %q", trace)
+	}
+	if n := d.Symbolize(s); n != 0 {
+		t.Errorf("expect the inlined frames added once, got %d goroutines symbolized again", n)
+	}
+}
+
+func Test_Contention(t *testing.T) {
+	var locs []*profile.Location
+	var funcs []*profile.Function
+	for i, name := range []string{"sync.(*Mutex).Unlock", "main.sleeper", "main.worker"} {
+		f := &profile.Function{ID: uint64(i + 1), Name: name}
+		funcs = append(funcs, f)
+		locs = append(locs, &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: f}}})
+	}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "contentions", Unit: "count"}, {Type: "delay", Unit: "nanoseconds"}},
+		PeriodType: &profile.ValueType{Type: "contentions", Unit: "count"},
+		Period:     1,
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{locs[0], locs[1]}, Value: []int64{3, 3e9}},
+			{Location: []*profile.Location{locs[0], locs[2]}, Value: []int64{1, 1e6}},
+		},
+		Location: locs,
+		Function: funcs,
+	}
+
+	fn := filepath.Join(t.TempDir(), "mutex.pb.gz")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	hot, err := loadContention(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spots, marked := d.CrossReference(hot)
+	if len(spots) != 2 || spots[0].Function != "main.sleeper" || spots[0].Count != 3 {
+		t.Fatalf("expect main.sleeper the hottest spot, got %+v", spots)
+	}
+	if marked["main.sleeper"] != 3 || marked["main.worker"] != 5 {
+		t.Errorf("expect 3 sleepers and 5 workers marked, got %v", marked)
+	}
+	if _, n, err := d.Search("contended", 0, 0); err != nil || n != 8 {
+		t.Errorf("expect 8 contended goroutines, got %d, %v", n, err)
+	}
+}
+
+func Test_LoadDefaults(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	config := `options:
+  display.maxframes: 4
+filters:
+  sleepy: "contains(trace, 'time.Sleep')"
+noise:
+  - "@sleepy"
+aliases:
+  workers: 'd.search("contains(trace, \"worker\")")'
+`
+	if err := os.WriteFile(fn, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		displayMaxFrames = 0
+		delete(filters, "sleepy")
+		delete(defaultFilters, "sleepy")
+		delete(aliases, "workers")
+		noiseFilters = nil
+	}()
+	if err := loadDefaults(fn); err != nil {
+		t.Fatal(err)
+	}
+	if displayMaxFrames != 4 || aliases["workers"] == "" || filters["sleepy"] == "" {
+		t.Fatalf("defaults not applied: maxframes %d, aliases %v, filters %v", displayMaxFrames, aliases, filters)
+	}
+
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(d.goroutines)
+	n, err := dropNoise(d)
+	if err != nil || n == 0 || len(d.goroutines) != before-n {
+		t.Errorf("expect the sleepers dropped, got %d, %v", n, err)
+	}
+
+	if err := os.WriteFile(fn, []byte("options:\n  no.such: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDefaults(fn); err == nil {
+		t.Error("expect an error for an unknown option")
+	}
+}
+
+func Test_Capture(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command needs a Unix shell")
+	}
+	d, err := capture("cat samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.goroutines) != len(want.goroutines) {
+		t.Errorf("expect %d goroutines captured, got %d", len(want.goroutines), len(d.goroutines))
+	}
+
+	if _, err := capture("exit 3"); err == nil {
+		t.Error("expect an error for a failed command")
+	}
+}
+
+func Test_Audit(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspace["t"] = d
+	fn := filepath.Join(t.TempDir(), "audit.log")
+	defer func() {
+		delete(workspace, "t")
+		undoStack, redoStack = nil, nil
+		setAudit("0")
+		auditJSON = false
+	}()
+
+	if err := set("set audit " + fn); err != nil {
+		t.Fatal(err)
+	}
+	execute(`t.delete("id > 100")`)
+	set("set audit.format json")
+	execute(`t.keep("nosuchfn(trace)")`)
+
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expect 3 lines logged, got %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], `{"deleted":0,"kept":10}`) || lines[1] != `t.delete("id > 100")` {
+		t.Errorf("expect the delete commented with its counts, got %q", lines[:2])
+	}
+	if !strings.Contains(lines[2], `"error":`) || !strings.Contains(lines[2], `"statement":"t.keep(\"nosuchfn(trace)\")"`) {
+		t.Errorf("expect the failed keep logged as JSON, got %q", lines[2])
+	}
+}
+
+func Test_Merge(t *testing.T) {
+	a, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Dedupe()
+	m := Merge([]string{"a", "b"}, []*GoroutineDump{a, b})
+	if len(m.goroutines) != len(a.goroutines)+len(b.goroutines) {
+		t.Fatalf("expect %d goroutines merged, got %d", len(a.goroutines)+len(b.goroutines), len(m.goroutines))
+	}
+	if _, n, err := m.Search("origin == 'b'", 0, 0); err != nil || n != len(b.goroutines) {
+		t.Errorf("expect %d goroutines from b, got %d, %v", len(b.goroutines), n, err)
+	}
+	if a.goroutines[0].origin != "" || b.goroutines[0].members[0].origin != "" {
+		t.Error("expect the merged dumps left unlabeled")
+	}
+
+	again := Merge([]string{"m", "c"}, []*GoroutineDump{m, a})
+	_, na, _ := again.Search("origin == 'a'", 0, 0)
+	_, nc, _ := again.Search("origin == 'c'", 0, 0)
+	if na != len(a.goroutines) || nc != len(a.goroutines) {
+		t.Errorf("expect the origins of the merged goroutines kept, got %d from a, %d from c", na, nc)
+	}
+}
+
+func Test_GroupByOrigin(t *testing.T) {
+	a, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := a.Copy("id < 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Merge([]string{"a", "b"}, []*GoroutineDump{a, b})
+	m.Dedupe()
+
+	counts, err := m.GroupBy("origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["a"] != len(a.goroutines) || counts["b"] != len(b.goroutines) {
+		t.Errorf("expect the deduped groups counted by origin, got %v", counts)
+	}
+	if _, err := m.GroupBy("trace"); err == nil {
+		t.Error("expect an error grouping by trace")
+	}
+
+	origins, dumps := m.ByOrigin()
+	if !reflect.DeepEqual(origins, []string{"a", "b"}) || len(dumps[1].goroutines) != len(b.goroutines) {
+		t.Errorf("expect the merged dump split back, got %v", origins)
+	}
+	if r := skewed(map[string]int{"a": 10, "b": 12, "c": 100}); len(r) != 1 || r["c"] < 8 {
+		t.Errorf("expect c skewed, got %v", r)
+	}
+}
+
+func Test_Requests(t *testing.T) {
+	dump := `goroutine 21 [select]:
+net/http.(*persistConn).roundTrip(0xc000218000, 0xc0001a2040)
+	/usr/lib/go/src/net/http/transport.go:2652 +0x979
+net/http.(*Transport).roundTrip(0xc0000f8000, 0xc0001c6000)
+	/usr/lib/go/src/net/http/transport.go:590 +0x7ba
+net/http.(*Client).do(0xc00007e300, 0xc0001c6000)
+	/usr/lib/go/src/net/http/client.go:727 +0x9f2
+main.search({0x7b3f40, 0xc0002a0000}, 0xc000296000)
+	/app/main.go:20 +0x65
+net/http.HandlerFunc.ServeHTTP(0x0?, {0x7b3f40?, 0xc0002a0000?}, 0x0?)
+	/usr/lib/go/src/net/http/server.go:2166 +0x29
+net/http.serverHandler.ServeHTTP({0xc000290000?}, {0x7b3f40?, 0xc0002a0000?}, 0x6?)
+	/usr/lib/go/src/net/http/server.go:3137 +0x8e
+net/http.(*conn).serve(0xc0002b6000, {0x7b4a18, 0xc000290030})
+	/usr/lib/go/src/net/http/server.go:2039 +0x5e8
+created by net/http.(*Server).Serve in goroutine 1
+	/usr/lib/go/src/net/http/server.go:3285 +0x4b4
+
+goroutine 22 [chan receive]:
+main.report({0x7b3f40, 0xc0002a0100}, 0xc000296100)
+	/app/main.go:30 +0x85
+net/http.HandlerFunc.ServeHTTP(0x0?, {0x7b3f40?, 0xc0002a0100?}, 0x0?)
+	/usr/lib/go/src/net/http/server.go:2166 +0x29
+net/http.serverHandler.ServeHTTP({0xc000290000?}, {0x7b3f40?, 0xc0002a0100?}, 0x6?)
+	/usr/lib/go/src/net/http/server.go:3137 +0x8e
+net/http.(*conn).serve(0xc0002b6100, {0x7b4a18, 0xc000290060})
+	/usr/lib/go/src/net/http/server.go:2039 +0x5e8
+created by net/http.(*Server).Serve in goroutine 1
+	/usr/lib/go/src/net/http/server.go:3285 +0x4b4
+
+goroutine 30 [select]:
+google.golang.org/grpc.(*ClientConn).Invoke(0xc000300000, {0x7b4a50, 0xc0002c0000}, {0x6f1a2b, 0x1c}, {0x6c3b40, 0xc0002c2000}, {0x6c3c00, 0xc0002c2040}, {0x0, 0x0, 0x0})
+	/go/pkg/mod/google.golang.org/grpc@v1.60.0/call.go:35 +0x223
+main.report.func1()
+	/app/main.go:34 +0x4c
+created by main.report in goroutine 22
+	/app/main.go:32 +0x6a
+
+goroutine 31 [sleep]:
+time.Sleep(0x3b9aca00)
+	/usr/lib/go/src/runtime/time.go:195 +0x125
+main.poll()
+	/app/main.go:40 +0x1d
+created by main.report.func1 in goroutine 30
+	/app/main.go:36 +0x8f
+
+goroutine 1 [IO wait]:
+net/http.(*Server).Serve(0xc0000f6000, {0x7b4840, 0xc0000a4000})
+	/usr/lib/go/src/net/http/server.go:3255 +0x33e
+main.main()
+	/app/main.go:50 +0x1c5
+`
+	d, err := parse(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RequestGroup{
+		{Kind: "http", Handler: "main.report", Requests: 1, Outbound: 1, Goroutines: 2},
+		{Kind: "http", Handler: "main.search", Requests: 1, Outbound: 1},
+	}
+	if got := d.Requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expect %+v, got %+v", want, got)
+	}
+}
+
+func Test_Report(t *testing.T) {
+	before, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := before.Copy("state != 'sync.Mutex.Lock'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := writeReport(&b, []string{"before", "after"}, []*GoroutineDump{before, after}); err != nil {
+		t.Fatal(err)
+	}
+	report := b.String()
+	for _, want := range []string{
+		"## Goroutines of after compared to before\n",
+		"| state class | before | after | delta |\n",
+		"| blocked-lock | 3 | 0 | -3 |\n",
+		"| **total** | 10 | 7 | -3 |\n",
+		"### Changed stack signatures\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("expect %q in the report, got\n%s", want, report)
+		}
+	}
+}
+
+func Test_TraceKeptInText(t *testing.T) {
+	original, err := os.ReadFile("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := parse(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range want.goroutines {
+		if b := g.buf.Bytes(); cap(b) != len(b) {
+			t.Errorf("expect the trace of goroutine %d kept in the text, got a buffer of %d bytes for %d", g.id, cap(b), len(b))
+		}
+	}
+
+	// A CRLF line ending in the middle of a trace makes it copied.
+	idx := bytes.Index(original, []byte("\n\t"))
+	mixed := append(append(append([]byte{}, original[:idx]...), '\r'), original[idx:]...)
+	d, err := parse(bytes.NewReader(mixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, g := range d.goroutines {
+		if g.buf.String() != want.goroutines[i].buf.String() || g.scrubbedHash != want.goroutines[i].scrubbedHash {
+			t.Errorf("goroutine %d differs:\n%s", g.id, g.buf.String())
+		}
+	}
+}
+
+func Test_Signature(t *testing.T) {
+	const dump = `goroutine 1 [select]:
+main.serve.func1({0x5e1ce8?, 0x1411c5144040?}, 0x1)
+	/app/main.go:10 +0x25
+created by main.serve in goroutine 7
+	/app/main.go:8 +0x37
+
+goroutine 2 [select]:
+main.serve.func1({0x5e1ce8?, 0x1411c5150000?}, 0x2)
+	/app/main.go:10 +0x2b
+created by main.serve in goroutine 9
+	/app/main.go:8 +0x41
+
+goroutine 3 [select]:
+main.serve.func2({0x5e1ce8?, 0x1411c5160000?}, 0x3)
+	/app/main.go:10 +0x25
+created by main.serve in goroutine 7
+	/app/main.go:8 +0x37
+`
+	defer func(v bool) { scrubClosures = v }(scrubClosures)
+	for _, tc := range []struct {
+		closures bool
+		kept     int
+	}{
+		{false, 2},
+		{true, 1},
+	} {
+		scrubClosures = tc.closures
+		d, err := parse(strings.NewReader(dump))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Dedupe()
+		if len(d.goroutines) != tc.kept {
+			t.Errorf("closures %v: expect %d goroutines kept, got %d", tc.closures, tc.kept, len(d.goroutines))
+		}
+	}
+}
+
+func Test_Interrupted(t *testing.T) {
+	var sb strings.Builder
+	for i := 1; i <= 3*minParallel; i++ {
+		fmt.Fprintf(&sb, "goroutine %d [select]:\nmain.worker()\n\t/app/main.go:10\n\n", i)
+	}
+	d, err := parse(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer func(ctx context.Context) { statementCtx = ctx }(statementCtx)
+	statementCtx = ctx
+	if _, err := d.Keep("id > 10"); err != errInterrupted {
+		t.Errorf("expect %v, got %v", errInterrupted, err)
+	}
+	if len(d.goroutines) != 3*minParallel {
+		t.Errorf("expect the dump intact, got %d goroutines", len(d.goroutines))
+	}
+}
+
+func Test_ParseProgress(t *testing.T) {
+	var sb strings.Builder
+	for i := 1; i <= 3*scanCheck; i++ {
+		fmt.Fprintf(&sb, "goroutine %d [select]:\nmain.worker()\n\t/app/main.go:10\n\n", i)
+	}
+	text := sb.String()
+
+	// Progress goes up with the text parsed, not read.
+	var reports []int64
+	d, err := parseContext(context.Background(), strings.NewReader(text), func(parsed, size int64) {
+		if size != int64(len(text)) {
+			t.Errorf("expect the size of the text %d, got %d", len(text), size)
+		}
+		reports = append(reports, parsed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.goroutines) != 3*scanCheck {
+		t.Errorf("expect %d goroutines, got %d", 3*scanCheck, len(d.goroutines))
+	}
+	if len(reports) < 4 || !sort.SliceIsSorted(reports, func(i, j int) bool { return reports[i] < reports[j] }) {
+		t.Errorf("expect the parsed bytes reported as parsing goes, got %v", reports)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := func(parsed, size int64) {
+		if parsed > size/2 {
+			cancel()
+		}
+	}
+	if _, err := parseContext(ctx, strings.NewReader(text), canceled); err != context.Canceled {
+		t.Errorf("expect %v once canceled while parsing, got %v", context.Canceled, err)
+	}
+}
+
+func Test_StateInDurationGt(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cond, want := range map[string]int{
+		"state_in('CHAN RECEIVE', ' running ')":         6,
+		"state_in('blocked-lock')":                      3,
+		"duration_gt('5m')":                             1,
+		"duration_gt('2m') && state_in('chan receive')": 2,
+		"duration_gt('1h')":                             0,
+		"!state_in('sleep', 'blocked-chan') && id > 1":  3,
+	} {
+		if _, n, err := d.Search(cond, 0, 0); err != nil || n != want {
+			t.Errorf("%s: expect %d goroutines, got %d, %v", cond, want, n, err)
+		}
+	}
+	for _, cond := range []string{"duration_gt('30')", "duration_gt(30)", "state_in(1)"} {
+		if _, _, err := d.Search(cond, 0, 0); err == nil {
+			t.Errorf("%s: expect an error", cond)
+		}
+	}
+}
+
+func Test_Assert(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for assertion, want := range map[string]bool{
+		`count("state == 'chan receive'") == 5`:                          true,
+		`count('contains(trace, "main.sleeper")') == 0`:                  false,
+		`count("main.worker") == 5 && total == 10`:                       true,
+		`count("duration_gt('10m')") > 1 || total > 100`:                 false,
+		`count("contains(trace, \"main.sleeper\")") == 3`:                true,
+		`count( 'state == \'chan receive\'' ) + count("main.none") == 5`: true,
+	} {
+		if passed, err := d.Assert(assertion); err != nil || passed != want {
+			t.Errorf("%s: expect %v, got %v, %v", assertion, want, passed, err)
+		}
+	}
+	for _, assertion := range []string{"total", "count() == 0", "count('state ==') == 0 &&"} {
+		if _, err := d.Assert(assertion); err == nil {
+			t.Errorf("%s: expect an error", assertion)
+		}
+	}
+
+	// The goroutines deduped into one and those of a debug=1 record count.
+	deduped, err := d.Copy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deduped.Dedupe()
+	profile, err := load("samples/profile1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, dump := range map[string]*GoroutineDump{"deduped": deduped, "debug=1": profile} {
+		for _, assertion := range []string{
+			`count("main.worker") == 5 && total == 10`,
+			`count('contains(trace, "main.sleeper")') == 3`,
+			`count("time.Sleep") == 1 && total > 9`,
+		} {
+			if passed, err := dump.Assert(assertion); err != nil || !passed {
+				t.Errorf("%s: %s: expect passed, got %v, %v", name, assertion, passed, err)
+			}
+		}
+	}
+}
+
+func Test_Stats(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := d.Stats()
+	if s.Goroutines != 10 || s.Signatures != 4 || s.Frames != 26 || s.MaxDepth != 5 || s.MaxDepthID != 11 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if s.Bytes <= 0 {
+		t.Errorf("expect the bytes held estimated, got %d", s.Bytes)
+	}
+
+	d.Dedupe()
+	deduped := d.Stats()
+	if deduped.Goroutines != 4 || deduped.Signatures != 4 || deduped.Frames != 12 || deduped.MaxDepth != 5 {
+		t.Errorf("unexpected stats of the deduped dump %+v", deduped)
+	}
+	if deduped.Bytes <= s.Bytes/2 {
+		t.Errorf("expect the bytes of the deduped members counted, got %d of %d", deduped.Bytes, s.Bytes)
+	}
+}
+
+func Test_Plugin(t *testing.T) {
+	names, err := loadPlugin("testdata/plugin.star")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, name := range names {
+			delete(functions, name)
+			delete(pluginFunctions, name)
+		}
+	}()
+	if !reflect.DeepEqual(names, []string{"depth", "is_worker"}) {
+		t.Errorf("expect the public functions registered, got %v", names)
+	}
+
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cond, want := range map[string]int{
+		"is_worker(trace)":                       5,
+		"!is_worker(trace) && depth(trace) >= 5": 3,
+		"depth(trace) == 3 && state == 'sleep'":  1,
+	} {
+		if _, n, err := d.Search(cond, 0, 0); err != nil || n != want {
+			t.Errorf("%s: expect %d goroutines, got %d, %v", cond, want, n, err)
+		}
+	}
+
+	if _, err := loadPlugin("testdata/override.star"); err == nil {
+		t.Error("expect an error overriding a builtin function")
+	}
+	if _, ok := pluginFunctions["contains"]; ok {
+		t.Error("expect contains() left builtin")
+	}
+}
+
+func Test_Filters(t *testing.T) {
+	defer func(saved map[string]string) { filters = saved }(filters)
+	filters = map[string]string{
+		"old":    "duration > 10",
+		"chan":   "state_class == 'blocked-chan'",
+		"leaky":  "@old && @chan",
+		"cycle1": "@cycle2",
+		"cycle2": "id > 1 || @cycle1",
+	}
+
+	for cond, want := range map[string]string{
+		"@leaky":                               "((duration > 10) && (state_class == 'blocked-chan'))",
+		"@old || id == 1":                      "(duration > 10) || id == 1",
+		"contains(trace, '@old') && @chan":     "contains(trace, '@old') && (state_class == 'blocked-chan')",
+		`contains(trace, "@old") && @chan`:     `contains(trace, "@old") && (state_class == 'blocked-chan')`,
+		`contains(trace, "it's @old") || @old`: `contains(trace, "it's @old") || (duration > 10)`,
+		`contains(trace, \"x\") && @old`:       `contains(trace, \"x\") && (duration > 10)`,
+	} {
+		got, err := expandFilters(cond)
+		if err != nil || got != want {
+			t.Errorf("%s: expect %s, got %s, %v", cond, want, got, err)
+		}
+	}
+
+	for _, cond := range []string{"@cycle1", "id > 1 && @cycle2", "@undefined"} {
+		if _, err := expandFilters(cond); err == nil {
+			t.Errorf("%s: expect an error", cond)
+		}
+	}
+
+	for cmd, want := range map[string]string{
+		"a.keep(@leaky)":           `a.keep("@leaky")`,
+		`a.keep("@leaky")`:         `a.keep("@leaky")`,
+		`a.search('@old', 0, 10)`:  `a.search('@old', 0, 10)`,
+		`a.keep("x \"@old\"", @y)`: `a.keep("x \"@old\"", "@y")`,
+	} {
+		if got := quoteFilterRefs(cmd); got != want {
+			t.Errorf("%s: expect %s, got %s", cmd, want, got)
+		}
+	}
+}
+
+// synthDump makes a dump of goroutines in select, as many in each function
+// as counts tells.
+func synthDump(t *testing.T, counts map[string]int) *GoroutineDump {
+	t.Helper()
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	id := 1
+	for _, name := range names {
+		for i := 0; i < counts[name]; i++ {
+			fmt.Fprintf(&sb, "goroutine %d [select]:\nmain.%s()\n\t/app/main.go:10\n\n", id, name)
+			id++
+		}
+	}
+	d, err := parse(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func Test_Leaks(t *testing.T) {
+	before := synthDump(t, map[string]int{"grown": 2, "quadrupled": 1, "huge": 1, "same": 4, "shrunk": 3})
+	after := synthDump(t, map[string]int{"grown": 5, "quadrupled": 4, "huge": 11, "same": 4, "shrunk": 1, "new": 3})
+
+	var got []string
+	for _, s := range Leaks(before, after) {
+		got = append(got, fmt.Sprintf("%s %d->%d", s.Sample.leafFunc(), s.Before, s.After))
+	}
+	// By growth, then by ratio, a new signature's being infinite.
+	want := []string{"main.huge 1->11", "main.new 0->3", "main.quadrupled 1->4", "main.grown 2->5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expect %v, got %v", want, got)
+	}
+
+	if suspects := Leaks(after, after); len(suspects) != 0 {
+		t.Errorf("expect no suspects between the same dumps, got %d", len(suspects))
+	}
+}
+
+func Test_Stuck(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		minutes int
+		total   int
+		want    []StuckGroup
+	}{
+		{3, 2, []StuckGroup{{Creator: "main.main /home/user/app/main.go:17", Count: 2, Longest: 12}}},
+		{4, 1, []StuckGroup{{Creator: "main.main /home/user/app/main.go:17", Count: 1, Longest: 12}}},
+		{13, 0, []StuckGroup{}},
+		{0, 10, []StuckGroup{
+			{Creator: "main.main /home/user/app/main.go:17", Count: 5, Longest: 12},
+			{Creator: "main.main /home/user/app/main.go:22", Count: 3, Longest: 0},
+			{Creator: "(no creator)", Count: 1, Longest: 0},
+			{Creator: "main.main /home/user/app/main.go:24", Count: 1, Longest: 0},
+		}},
+	} {
+		stuck, total := d.Stuck(tc.minutes)
+		if total != tc.total || !reflect.DeepEqual(stuck, tc.want) {
+			t.Errorf("%d minutes: expect %d goroutines in %+v, got %d in %+v", tc.minutes, tc.total, tc.want, total, stuck)
+		}
+	}
+
+	// The members of a deduped group are counted with their own durations.
+	d.Dedupe()
+	if stuck, total := d.Stuck(3); total != 2 || len(stuck) != 1 || stuck[0].Longest != 12 {
+		t.Errorf("expect the 2 deduped goroutines waiting for 3 minutes or more, got %d in %+v", total, stuck)
+	}
+
+	workspace["t"] = d
+	defer delete(workspace, "t")
+	for _, stmt := range []string{"t.stuck(-5)", "t.stuck(\"5\")", "t.stuck(1.5)"} {
+		if err := expr(stmt); err == nil {
+			t.Errorf("%s: expect an error", stmt)
+		}
+	}
+}
+
+func Test_Explain(t *testing.T) {
+	defer func(rules []rule) { userRules = rules }(userRules)
+	userRules = nil
+
+	for fn, want := range map[string]string{
+		"net/http.(*conn).serve(0xc0002b6000, {0x7b4a18, 0xc000290030})":              "http.Server connection waiting for or serving a request, normal",
+		"net/http.(*Server).Serve(0xc000184000, {0x7b4a18, 0xc000290030})":            "http.Server accepting connections, normal",
+		"net/http.(*persistConn).readLoop(0xc000218000)":                              "http.Transport keep-alive connection reader, normal",
+		"net/http.(*persistConn).writeLoop(0xc000218000)":                             "http.Transport keep-alive connection writer, normal",
+		"net/http.(*http2serverConn).serve(0xc000300000)":                             "http2 server connection, normal",
+		"database/sql.(*DB).connectionOpener(0xc0001a0000, {0x7b4a18, 0xc000290030})": "database/sql connection opener, normal",
+		"os/signal.signal_recv()":                                                     "os/signal notification loop, normal",
+		"os/signal.loop()":                                                            "os/signal notification loop, normal",
+		"context.propagateCancel.func2()":                                             "context cancellation propagation, normal unless numerous",
+		"time.Sleep(0x34630b8a000)":                                                   "sleeping in time.Sleep",
+		"sync.(*WaitGroup).Wait(0xc000010000)":                                        "waiting for a sync.WaitGroup",
+		"sync.(*RWMutex).RLock(...)":                                                  "waiting for a mutex, check its holder if numerous",
+		"sync.(*Cond).Wait(0xc000010000)":                                             "waiting for a sync.Cond",
+		"main.worker(...)":                                                            "",
+	} {
+		d, err := parse(strings.NewReader(fmt.Sprintf("goroutine 1 [select]:\n%s\n\t/src/file.go:10 +0x25\n", fn)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := explain(d.goroutines[0]); got != want {
+			t.Errorf("%s: expect %q, got %q", fn, want, got)
+		}
+	}
+
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Dedupe()
+	explained, unexplained, signatures := d.Explain()
+	want := []Explanation{
+		{Text: "waiting for a mutex, check its holder if numerous", Count: 3, Signatures: 1},
+		{Text: "sleeping in time.Sleep", Count: 1, Signatures: 1},
+	}
+	if !reflect.DeepEqual(explained, want) || unexplained != 6 || signatures != 2 {
+		t.Errorf("expect %+v and 6 unexplained in 2 signatures, got %+v and %d in %d", want, explained, unexplained, signatures)
+	}
+
+	// The explanations are attached to the groups and their members.
+	if g := d.Find(12); g == nil || g.explanation != want[0].Text || !g.hasTag("explained") {
+		t.Errorf("expect goroutine 12 explained, got %+v", g)
+	}
+	for cond, n := range map[string]int{
+		"has_tag('explained')":           2,
+		"!has_tag('explained')":          2,
+		"contains(explanation, 'mutex')": 1,
+		"explanation == ''":              2,
+	} {
+		if _, got, err := d.Search(cond, 0, 0); err != nil || got != n {
+			t.Errorf("%s: expect %d groups, got %d, %v", cond, n, got, err)
+		}
+	}
+
+	// User rules come first.
+	userRules = []rule{{regexp.MustCompile(`main\.sleeper`), "sleeper waiting for its turn"}}
+	if explained, _, _ := d.Explain(); explained[0].Text != "sleeper waiting for its turn" {
+		t.Errorf("expect the user rule to take precedence, got %+v", explained)
+	}
+}
+
+func Test_Count(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := load("samples/profile1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deduped, err := d.Copy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deduped.Dedupe()
+
+	for _, tc := range []struct {
+		name string
+		d    *GoroutineDump
+	}{
+		{"original", d},
+		{"deduped", deduped},
+		{"debug=1", profile},
+	} {
+		for arg, want := range map[string]int{
+			"main.worker":                5,
+			`"state_class == 'unknown'"`: 0,
+			"contains(trace, 'sync.')":   3,
+			"contains(trace, 'main.sleeper') || contains(trace, 'time.Sleep')": 4,
+		} {
+			if tc.name == "debug=1" && arg == `"state_class == 'unknown'"` {
+				want = 10
+			}
+			matched, total, err := tc.d.Count(arg)
+			if err != nil || matched != want || total != 10 {
+				t.Errorf("%s: %s: expect %d of 10 goroutines, got %d of %d, %v", tc.name, arg, want, matched, total, err)
+			}
+		}
+	}
+}
+
+func Test_DiffDeduped(t *testing.T) {
+	before := synthDump(t, map[string]int{"a": 2, "b": 3, "c": 1})
+	after := synthDump(t, map[string]int{"a": 5, "b": 3, "d": 4})
+	before.Dedupe()
+	after.Dedupe()
+
+	lonly, common, ronly := before.Diff(after)
+	funcs := func(d *GoroutineDump) (fs []string) {
+		for _, g := range d.goroutines {
+			fs = append(fs, fmt.Sprintf("%s %d", g.leafFunc(), g.weight()))
+		}
+		return fs
+	}
+	if got := funcs(lonly); !reflect.DeepEqual(got, []string{"main.c 1"}) {
+		t.Errorf("expect main.c only before, got %v", got)
+	}
+	if got := funcs(common); !reflect.DeepEqual(got, []string{"main.a 5", "main.b 3"}) {
+		t.Errorf("expect main.a and main.b in both with their sizes after, got %v", got)
+	}
+	if got := funcs(ronly); !reflect.DeepEqual(got, []string{"main.d 4"}) {
+		t.Errorf("expect main.d only after, got %v", got)
+	}
+
+	var deltas []string
+	for _, d := range GroupDeltas(before, after) {
+		deltas = append(deltas, fmt.Sprintf("%s %d->%d", d.Sample.leafFunc(), d.Before, d.After))
+	}
+	if want := []string{"main.a 2->5", "main.b 3->3"}; !reflect.DeepEqual(deltas, want) {
+		t.Errorf("expect %v, got %v", want, deltas)
+	}
+}
+
+func Test_Partition(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Note("taken during the incident"); err != nil {
+		t.Fatal(err)
+	}
+
+	matched, others, err := d.Partition("state == 'chan receive'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matched.goroutines) != 5 || len(others.goroutines) != 5 {
+		t.Errorf("expect 5 goroutines matched and 5 not, got %d and %d", len(matched.goroutines), len(others.goroutines))
+	}
+	seen := map[int]int{}
+	for _, g := range append(matched.Goroutines(), others.Goroutines()...) {
+		seen[g.id]++
+	}
+	for _, g := range d.goroutines {
+		if seen[g.id] != 1 {
+			t.Errorf("expect goroutine %d in exactly one partition, got %d", g.id, seen[g.id])
+		}
+	}
+	for _, p := range []*GoroutineDump{matched, others} {
+		if !reflect.DeepEqual(p.notes, d.notes) {
+			t.Errorf("expect the notes of the dump kept, got %v", p.notes)
+		}
+	}
+
+	// Adding a note to a partition leaves the others alone.
+	matched.Note("only matched")
+	if len(others.notes) != 1 || len(d.notes) != 1 {
+		t.Errorf("expect the notes not shared, got %v and %v", others.notes, d.notes)
+	}
+
+	if _, _, err := d.Partition("state =="); err == nil {
+		t.Error("expect an invalid condition rejected")
+	}
+}
+
+func Test_SummaryAll(t *testing.T) {
+	d, err := load("samples/stack2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := synthDump(t, map[string]int{"x": 4})
+
+	want := SummaryMatrix{
+		Rows:   []string{"blocked-chan", "blocked-lock", "running", "sleeping"},
+		Counts: [][]int{{5, 4}, {3, 0}, {1, 0}, {1, 0}},
+		Totals: []int{10, 4},
+	}
+	if m := SummaryAll([]*GoroutineDump{d, other}, false); !reflect.DeepEqual(m, want) {
+		t.Errorf("expect %+v, got %+v", want, m)
+	}
+
+	// Deduped goroutines count with their duplicates.
+	d.Dedupe()
+	if m := SummaryAll([]*GoroutineDump{d, other}, false); !reflect.DeepEqual(m, want) {
+		t.Errorf("deduped: expect %+v, got %+v", want, m)
+	}
+
+	m := SummaryAll([]*GoroutineDump{d, other}, true)
+	if len(m.Rows) != 5 || m.Rows[0] != "main.worker" || m.Rows[1] != "main.x" ||
+		!reflect.DeepEqual(m.Counts[:2], [][]int{{5, 0}, {0, 4}}) || !reflect.DeepEqual(m.Totals, want.Totals) {
+		t.Errorf("unexpected summary by signature %+v", m)
+	}
+}
+
+func Test_PageArgs(t *testing.T) {
+	for _, tc := range []struct {
+		call          string
+		offset, limit int
+		ok            bool
+	}{
+		{"f()", 0, 10, true},
+		{"f(15)", 15, 10, true},
+		{"f(15, 1)", 15, 1, true},
+		{"f(-1)", 0, 0, false},
+		{"f(0, 0)", 0, 0, false},
+		{"f(0, x)", 0, 0, false},
+		{`f("a")`, 0, 0, false},
+	} {
+		ex, err := parser.ParseExpr(tc.call)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, limit, err := pageArgs(ex.(*ast.CallExpr).Args)
+		if (err == nil) != tc.ok || offset != tc.offset || limit != tc.limit {
+			t.Errorf("%s: expect %d, %d, ok %v, got %d, %d, %v", tc.call, tc.offset, tc.limit, tc.ok, offset, limit, err)
+		}
+	}
+}
+
+func Test_Show(t *testing.T) {
+	workspace["t"] = synthDump(t, map[string]int{"a": 25})
+	defer func() {
+		delete(workspace, "t")
+		lastPager = nil
+	}()
+
+	shown := func(stmt string) interface{} {
+		execute(stmt)
+		return lastResult["shown"]
+	}
+	if n := shown("t.show()"); n != 25 {
+		t.Errorf("expect all the 25 goroutines shown by default, got %v", n)
+	}
+	if err := page("next"); err == nil {
+		t.Error("expect no page after all the goroutines")
+	}
+	if n := shown("t.show(5)"); n != 10 {
+		t.Errorf("expect 10 goroutines shown from an offset, got %v", n)
+	}
+	if n := shown("t.show(20, 10)"); n != 5 {
+		t.Errorf("expect the last 5 goroutines shown, got %v", n)
+	}
+	if err := page("prev"); err != nil || lastResult["shown"] != 10 {
+		t.Errorf("expect the previous 10 goroutines shown, got %v, %v", lastResult["shown"], err)
+	}
+}
+
+func Test_WatchAddrInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if err := watch("samples/stack2.txt", time.Hour, ln.Addr().String()); err == nil {
+		t.Error("expect an error serving the metrics on an address in use")
+	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// LeakSuspect is a stack signature whose goroutines grew between two dumps.
+type LeakSuspect struct {
+	Before int
+	After  int
+	Growth int
+	Ratio  float64 // After divided by Before, +Inf for new signatures.
+	Sample *Goroutine
+}
+
+// weight returns the number of goroutines represented by g.
+func (g *Goroutine) weight() int {
+	if n := g.Dups(); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// countSignatures returns the number of goroutines by stack signature, and a
+// representative goroutine of each signature.
+func (gd GoroutineDump) countSignatures() (map[string]int, map[string]*Goroutine) {
+	counts := map[string]int{}
+	samples := map[string]*Goroutine{}
+	for _, g := range gd.goroutines {
+		counts[g.scrubbedHash] += g.weight()
+		if _, ok := samples[g.scrubbedHash]; !ok {
+			samples[g.scrubbedHash] = g
+		}
+	}
+	return counts, samples
+}
+
+// GroupDelta is the number of goroutines of a stack signature in two dumps.
+type GroupDelta struct {
+	Before int
+	After  int
+	Sample *Goroutine
+}
+
+// GroupDeltas compares the goroutines by stack signature between the dumps
+// before and after, and returns the signatures found in both, the largest
+// absolute change first.
+func GroupDeltas(before, after *GoroutineDump) []GroupDelta {
+	bcounts, _ := before.countSignatures()
+	acounts, samples := after.countSignatures()
+
+	var deltas []GroupDelta
+	for sig, n := range acounts {
+		if b, ok := bcounts[sig]; ok {
+			deltas = append(deltas, GroupDelta{Before: b, After: n, Sample: samples[sig]})
+		}
+	}
+	sortGroupDeltas(deltas)
+	return deltas
+}
+
+// sortGroupDeltas sorts the deltas by the largest absolute change first, then
+// by the id of their sample goroutines.
+func sortGroupDeltas(deltas []GroupDelta) {
+	abs := func(n int) int {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		di, dj := abs(deltas[i].After-deltas[i].Before), abs(deltas[j].After-deltas[j].Before)
+		if di != dj {
+			return di > dj
+		}
+		return deltas[i].Sample.id < deltas[j].Sample.id
+	})
+}
+
+// Leaks compares the goroutines by stack signature between the dumps before
+// and after, and returns the signatures which grew, the largest absolute
+// growth first, then the largest relative growth.
+func Leaks(before, after *GoroutineDump) []LeakSuspect {
+	bcounts, _ := before.countSignatures()
+	acounts, samples := after.countSignatures()
+
+	var suspects []LeakSuspect
+	for sig, n := range acounts {
+		b := bcounts[sig]
+		if n <= b {
+			continue
+		}
+		ratio := math.Inf(1)
+		if b > 0 {
+			ratio = float64(n) / float64(b)
+		}
+		suspects = append(suspects, LeakSuspect{
+			Before: b,
+			After:  n,
+			Growth: n - b,
+			Ratio:  ratio,
+			Sample: samples[sig],
+		})
+	}
+
+	sort.Slice(suspects, func(i, j int) bool {
+		if suspects[i].Growth != suspects[j].Growth {
+			return suspects[i].Growth > suspects[j].Growth
+		}
+		if suspects[i].Ratio != suspects[j].Ratio {
+			return suspects[i].Ratio > suspects[j].Ratio
+		}
+		return suspects[i].Sample.id < suspects[j].Sample.id
+	})
+	return suspects
+}
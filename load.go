@@ -2,42 +2,258 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
 )
 
 var (
-	startLinePattern = regexp.MustCompile(`^goroutine\s+(\d+)\s+\[(.*)\]:$`)
+	startLinePattern   = regexp.MustCompile(`^goroutine\s+(\d+)\s+(?:gp=\S+\s+m=\S+\s+(?:mp=\S+\s+)?)?\[(.*)\]:$`)
+	profileLinePattern = regexp.MustCompile(`^goroutine profile: total (\d+)$`)
+	recordLinePattern  = regexp.MustCompile(`^(\d+) @( 0x[0-9a-f]+)*$`)
+
+	// threadLinePattern matches the lines the runtime prints about the
+	// threads when it crashes or gets SIGQUIT: the signal, the registers and
+	// the separators between threads.
+	threadLinePattern = regexp.MustCompile(`^(?:[A-Z]+: .*|PC=0x[0-9a-f]+ m=\d+ .*|[a-z][a-z0-9]{1,6}\s+0x[0-9a-f]+|-----)$`)
+
+	errLoadCanceled = errors.New("load canceled")
+
+	utf8BOM = []byte{0xef, 0xbb, 0xbf}
 )
 
 func load(fn string) (*GoroutineDump, error) {
+	return loadContext(context.Background(), fn, nil)
+}
+
+// loadContext loads the dump file, or the standard input if fn is "-",
+// reporting the bytes of its text parsed so far to progress if it's not nil.
+// Loading stops once ctx is done.
+func loadContext(ctx context.Context, fn string, progress func(parsed, size int64)) (*GoroutineDump, error) {
 	fn = strings.Trim(fn, "\"")
-	f, err := os.Open(fn)
+	f := os.Stdin
+	if fn != "-" {
+		var err error
+		if f, err = os.Open(fn); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+
+	start := time.Now()
+	dump, err := parseContext(ctx, &contextReader{ctx: ctx, r: f}, progress)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errLoadCanceled
+		}
+		return nil, err
+	}
+	if symbols != nil {
+		dump.Symbolize(symbols)
+	}
+	dump.parseTime = time.Since(start)
+	return dump, nil
+}
+
+// contextReader fails reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// parse reads a goroutine dump in any of the pprof debug levels: the binary
+// profile (debug=0), the aggregated text (debug=1) and the full goroutine
+// stacks (debug=2, also what a panic or SIGQUIT prints). Dumps compressed with
+// gzip or zstd are decompressed transparently.
+func parse(r io.Reader) (*GoroutineDump, error) {
+	return parseContext(context.Background(), r, nil)
+}
+
+// parseContext parses the dump as parse, reporting the bytes of its text
+// parsed so far to progress if it's not nil. Parsing stops once ctx is done.
+func parseContext(ctx context.Context, r io.Reader, progress func(parsed, size int64)) (*GoroutineDump, error) {
+	br := bufio.NewReader(r)
+	dr, err := decompress(br)
+	if err != nil {
+		return nil, err
+	}
+	if dr != nil {
+		defer dr.Close()
+		br = bufio.NewReader(dr)
+	}
+
+	// Dumps saved on Windows or by some log pipelines start with a UTF-8
+	// byte order mark. Their CRLF line endings are dropped by the scanner.
+	if bom, _ := br.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if isBinary(head) {
+		return parseProfile(br)
+	}
+
+	// The whole text is kept, the stack traces refer to it rather than
+	// holding copies.
+	data, err := io.ReadAll(br)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	scanner := &lineScanner{ctx: ctx, data: data, progress: progress}
+	dump := NewGoroutineDump()
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if m := profileLinePattern.FindStringSubmatch(line); m != nil {
+			total, _ := strconv.Atoi(m[1])
+			dump, err = parseAggregated(scanner, total)
+		} else {
+			dump, err = parseStacks(scanner, line)
+		}
+		break
+	}
+	if scanner.err != nil {
+		return nil, scanner.err
+	}
+	return dump, err
+}
+
+// parseStacks parses the debug=2 format. The first line has already been
+// consumed by the caller. Entries with malformed headers are skipped, and
+// truncated stacks are kept but reported.
+func parseStacks(scanner *lineScanner, first string) (*GoroutineDump, error) {
+	dump := NewGoroutineDump()
+	var goroutine *Goroutine
+	headerLine := 0
+	started, blank := false, false
+
+	finish := func() {
+		if goroutine == nil {
+			return
+		}
+		goroutine.Freeze()
+		if reason := incompleteStack(goroutine); reason != "" {
+			dump.warn(headerLine, fmt.Sprintf("goroutine %d: %s", goroutine.id, reason))
+		}
+		goroutine = nil
+	}
+
+	for line, ok := first, true; ok; line, ok = nextLine(scanner) {
+		if startLinePattern.MatchString(line) || isHeaderLike(line) {
+			started = true
+			finish()
+
+			var err error
+			if goroutine, err = NewGoroutine(line); err != nil {
+				dump.warn(scanner.n, err.Error())
+				continue
+			}
+			headerLine = scanner.n
+			dump.Add(goroutine)
+		} else if started && threadLinePattern.MatchString(line) {
+			// The thread states don't belong to the goroutine before.
+			finish()
+			dump.threads = append(dump.threads, line)
+		} else if goroutine != nil && blank && line != "" {
+			// Goroutines are separated by a blank line, what follows one
+			// is not part of the goroutine before, but maybe the remains of
+			// a dump cut off and appended to.
+			finish()
+			dump.warn(scanner.n, fmt.Sprintf("unexpected line %q outside of a goroutine", line))
+		} else if goroutine != nil {
+			goroutine.addLine(line, scanner.raw())
+		} else if !started {
+			dump.preamble = append(dump.preamble, line)
+		}
+		blank = line == ""
+	}
+	finish()
+	return dump, nil
+}
+
+// isHeaderLike tells if the line looks like a goroutine header, possibly cut
+// off, to report it instead of mixing it into the previous stack trace.
+func isHeaderLike(line string) bool {
+	if !strings.HasPrefix(line, "goroutine ") {
+		return false
+	}
+	return strings.HasSuffix(line, ":") || (len(line) > 10 && line[10] >= '0' && line[10] <= '9')
+}
 
+// locationPattern matches the location line of a debug=2 frame.
+var locationPattern = regexp.MustCompile(`^\t.*:\d+( |$)`)
+
+// incompleteStack tells why the stack of the goroutine looks cut off, or ""
+// if it looks complete: each function line must be followed by its location.
+func incompleteStack(g *Goroutine) string {
+	if g.external {
+		return ""
+	}
+	st := splitStack(g.buf.String())
+	if len(st.frames) == 0 && len(st.creator) == 0 {
+		return "no stack frames, the dump may be truncated"
+	}
+	last := st.creator
+	if len(last) == 0 {
+		last = st.frames[len(st.frames)-1]
+	}
+	// Skip the "...additional frames elided..." marker of deep stacks.
+	for len(last) > 1 && strings.HasPrefix(last[len(last)-1], "...") {
+		last = last[:len(last)-1]
+	}
+	if len(last) < 2 || !locationPattern.MatchString(last[len(last)-1]) {
+		return "stack cut off, the dump may be truncated"
+	}
+	return ""
+}
+
+// parseAggregated parses the debug=1 format, where each record starts with
+// "<count> @ <pc>..." followed by "#\t"-prefixed symbolized frames. The
+// "goroutine profile: total N" line has already been consumed.
+func parseAggregated(scanner *lineScanner, total int) (*GoroutineDump, error) {
 	dump := NewGoroutineDump()
 	var goroutine *Goroutine
+	headerLine := scanner.n
 
-	scanner := bufio.NewScanner(f)
+	sum := 0
 	for scanner.Scan() {
 		line := scanner.Text()
-		if startLinePattern.MatchString(line) {
-			//cleanup
+		if recordLinePattern.MatchString(line) {
 			if goroutine != nil {
 				goroutine.Freeze()
 			}
 
-			goroutine, err = NewGoroutine(line)
+			var err error
+			goroutine, err = NewAggregatedGoroutine(line)
 			if err != nil {
-				return nil, err
+				dump.warn(scanner.n, err.Error())
+				continue
 			}
+			sum += goroutine.count
 			dump.Add(goroutine)
-		} else if goroutine != nil {
-			goroutine.AddLine(line)
+		} else if goroutine != nil && strings.HasPrefix(line, "#") {
+			goroutine.addLine(line, scanner.raw())
 		}
 	}
 
@@ -45,8 +261,112 @@ func load(fn string) (*GoroutineDump, error) {
 		goroutine.Freeze()
 	}
 
-	if err := scanner.Err(); err != nil {
+	if sum != total {
+		dump.warn(headerLine, fmt.Sprintf("profile header claims %d goroutines, found %d", total, sum))
+	}
+	return dump, nil
+}
+
+// parseProfile parses the debug=0 format, a pprof protobuf. Each
+// sample is turned into a record of the debug=1 format.
+func parseProfile(r io.Reader) (*GoroutineDump, error) {
+	p, err := profile.Parse(r)
+	if err != nil {
 		return nil, err
 	}
+
+	dump := NewGoroutineDump()
+	for _, s := range p.Sample {
+		if len(s.Value) == 0 {
+			continue
+		}
+
+		pcs := make([]string, 0, len(s.Location))
+		for _, loc := range s.Location {
+			pcs = append(pcs, fmt.Sprintf("%#x", loc.Address))
+		}
+		goroutine, err := NewAggregatedGoroutine(fmt.Sprintf("%d @ %s", s.Value[0], strings.Join(pcs, " ")))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, loc := range s.Location {
+			if len(loc.Line) == 0 {
+				goroutine.AddLine(fmt.Sprintf("#\t%#x", loc.Address))
+				continue
+			}
+			for _, ln := range loc.Line {
+				if ln.Function == nil {
+					goroutine.AddLine(fmt.Sprintf("#\t%#x", loc.Address))
+					continue
+				}
+				goroutine.AddLine(fmt.Sprintf("#\t%#x\t%s\t%s:%d", loc.Address, ln.Function.Name, ln.Function.Filename, ln.Line))
+			}
+		}
+		goroutine.Freeze()
+		dump.Add(goroutine)
+	}
 	return dump, nil
 }
+
+// scanCheck is the number of lines scanned between two progress reports.
+const scanCheck = 1024
+
+// lineScanner splits the text of a dump into lines, counting them. Like
+// bufio.ScanLines, it drops the line endings, "\n" or "\r\n". Every
+// scanCheck lines, it reports the bytes scanned to progress if it's not
+// nil, and stops with err set if ctx is done.
+type lineScanner struct {
+	ctx        context.Context
+	data       []byte
+	start, end int // The current line, without its line ending.
+	next       int // The start of the next line.
+	n          int
+	progress   func(parsed, size int64)
+	err        error
+}
+
+func (s *lineScanner) Scan() bool {
+	if s.next >= len(s.data) || s.err != nil {
+		return false
+	}
+	if s.n%scanCheck == 0 {
+		if s.ctx != nil {
+			if s.err = s.ctx.Err(); s.err != nil {
+				return false
+			}
+		}
+		if s.progress != nil {
+			s.progress(int64(s.next), int64(len(s.data)))
+		}
+	}
+	s.start = s.next
+	if i := bytes.IndexByte(s.data[s.start:], '\n'); i >= 0 {
+		s.end, s.next = s.start+i, s.start+i+1
+	} else {
+		s.end, s.next = len(s.data), len(s.data)
+	}
+	s.n++
+	return true
+}
+
+// Text returns the current line.
+func (s *lineScanner) Text() string {
+	return string(bytes.TrimSuffix(s.data[s.start:s.end], []byte("\r")))
+}
+
+// raw returns the current line with its "\n" line ending in the text, or nil
+// if it doesn't end so.
+func (s *lineScanner) raw() []byte {
+	if s.next == s.end || (s.end > s.start && s.data[s.end-1] == '\r') {
+		return nil
+	}
+	return s.data[s.start:s.next]
+}
+
+func nextLine(scanner *lineScanner) (string, bool) {
+	if scanner.Scan() {
+		return scanner.Text(), true
+	}
+	return "", false
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -9,35 +10,53 @@ import (
 	"strings"
 
 	"os"
+	"os/signal"
+	"path/filepath"
 
 	"sort"
+	"time"
 
 	sgr "github.com/foize/go.sgr"
 	"github.com/peterh/liner"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
 )
 
 var (
 	assignPattern = regexp.MustCompile(`^\s*[_a-zA-Z][_a-zA-Z0-9]*(\s*,\s*[_a-zA-Z][_a-zA-Z0-9]*)*\s*=\s*.*$`)
 	cdPattern     = regexp.MustCompile(`^\s*cd\s*.*$`)
 
+	nonIdentPattern = regexp.MustCompile(`[^_a-zA-Z0-9]+`)
+
 	commands = map[string]string{
-		"?":      "Show this help",
-		"cd":     "Change current working directory",
-		"clear":  "Clear the workspace",
-		"exit":   "Exit the interactive shell",
-		"help":   "Show this help",
-		"ls":     "Show files in current directory",
-		"pwd":    "Show current working directory",
-		"quit":   "Quit the interactive shell",
-		"whos":   "Show all varaibles in workspace",
-		"dedupe": "Dedupe the stack",
+		"!":         "Run a shell command, \"!<command>\"",
+		"?":         "Show this help",
+		"cd":        "Change current working directory",
+		"clear":     "Clear the workspace",
+		"deffilter": "Define a named filter, \"deffilter <name> <condition>\"",
+		"exit":      "Exit the interactive shell",
+		"help":      "Show this help",
+		"ls":        "Show files in current directory",
+		"next":      "Show the next page of the last show() or search()",
+		"prev":      "Show the previous page of the last show() or search()",
+		"pwd":       "Show current working directory",
+		"quit":      "Quit the interactive shell",
+		"redo":      "Redo the last change undone",
+		"result":    "Print the counts of the last statement as JSON",
+		"set":       "Show or change options, \"set <name> <value>\"",
+		"undo":      "Undo the last change to a dump var",
+		"whos":      "Show all varaibles in workspace",
+		"dedupe":    "Dedupe the stack",
 	}
 	cmds []string
 	line *liner.State
 
 	workspace  = map[string]*GoroutineDump{}
-	dedupeFile = flag.String("df", "", "dedupe file")
+	dedupeFile = flag.String("df", "", "dedupe file, \"-\" to dedupe stdin to stdout")
+
+	watchSource   = flag.String("watch", "", "periodically load the dump from a pprof URL or a file")
+	watchInterval = flag.Duration("interval", 30*time.Second, "interval between the loads of -watch")
+	metricsAddr   = flag.String("metrics", "", "address serving the metrics of -watch, e.g. \":9465\"")
 )
 
 func init() {
@@ -54,8 +73,80 @@ func main() {
 
 	if *dedupeFile != "" {
 		processFile(*dedupeFile)
+		return
+	}
+	if *watchSource != "" {
+		if err := watch(*watchSource, *watchInterval, *metricsAddr); err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	loadPlugins(getPluginDir())
+	if rules, err := loadRules(getRulesFile()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading rules %s.\n", err)
 	} else {
-		runShell()
+		userRules = rules
+	}
+	if err := loadDefaults(getDefaultsFile()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading defaults %s.\n", err)
+	}
+	if args := flag.Args(); len(args) > 0 && args[0] == "assert" {
+		// The named filters and options of the shell apply to assertions.
+		runConfFile()
+		var files []string
+		if len(args) > 2 {
+			files = args[2:]
+		}
+		os.Exit(assertFiles(flag.Arg(1), files))
+	}
+
+	stdin := false
+	for _, fn := range flag.Args() {
+		d, err := load(fn)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		k := varName(fn)
+		workspace[k] = d
+		fmt.Printf("%s = load(%q)\n", k, fn)
+		printWarnings(d)
+		applyNoise(d)
+		printSummary(d)
+		stdin = stdin || fn == "-"
+	}
+	if stdin && !term.IsTerminal(int(os.Stdin.Fd())) {
+		// The dump was piped in, talk to the terminal instead.
+		if err := attachTerminal(); err != nil {
+			return
+		}
+	}
+	runShell()
+	if assertionFailed {
+		os.Exit(assertFailed)
+	}
+}
+
+// varName derives a workspace variable name from the dump file name.
+func varName(fn string) string {
+	if fn == "-" {
+		return "stdin"
+	}
+	base := filepath.Base(fn)
+	if idx := strings.Index(base, "."); idx > 0 {
+		base = base[:idx]
+	}
+	k := nonIdentPattern.ReplaceAllString(base, "_")
+	if k == "" || (k[0] >= '0' && k[0] <= '9') {
+		k = "_" + k
+	}
+	for i, name := 2, k; ; i++ {
+		if _, ok := workspace[name]; !ok {
+			return name
+		}
+		name = fmt.Sprintf("%s%d", k, i)
 	}
 }
 
@@ -66,9 +157,21 @@ func processFile(f string) {
 		os.Exit(1)
 	}
 
+	for _, w := range d.Warnings() {
+		logrus.Warnf("line %d: %s", w.Line, w.Reason)
+	}
+
 	d.Dedupe()
+	if f == "-" {
+		if err := d.Write(os.Stdout, false); err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	df := *dedupeFile + ".dedupe"
-	if err := d.Save(df); err != nil {
+	if err := d.Save(df, false); err != nil {
 		logrus.Error(err)
 		os.Exit(1)
 	}
@@ -80,71 +183,18 @@ func runShell() {
 	defer line.Close()
 	defer saveLiner(line)
 
+	runConfFile()
+
 	for {
 		if cmd, err := line.Prompt(">> "); err == nil {
 			cmd = strings.TrimSpace(cmd)
-			if cmd == "" {
+			if cmd == "" || strings.HasPrefix(cmd, "#") {
 				continue
 			}
 			line.AppendHistory(cmd)
 
-			switch cmd {
-			case "?", "help":
-				printHelp()
-			case "clear":
-				workspace = map[string]*GoroutineDump{}
-				fmt.Println("Workspace cleared.")
-			case "exit", "quit":
+			if !execute(cmd) {
 				return
-			case "ls":
-				wd, err := os.Getwd()
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-				printDir(wd)
-			case "pwd":
-				wd, err := os.Getwd()
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-				fmt.Println(wd)
-			case "whos":
-				if len(workspace) == 0 {
-					fmt.Println("No variables defined.")
-					continue
-				}
-				for k := range workspace {
-					fmt.Printf("%s\t", k)
-				}
-				fmt.Println()
-			default:
-				if cdPattern.MatchString(cmd) {
-					// Change directory.
-					idx := strings.Index(cmd, "cd")
-					dir := strings.TrimSpace(cmd[idx+2:])
-					if dir == "" {
-						fmt.Println("Expect command \"cd <dir>\"")
-						continue
-					}
-					if err := os.Chdir(dir); err != nil {
-						fmt.Println(err)
-					}
-					continue
-				}
-
-				// Assignment.
-				if assignPattern.MatchString(cmd) {
-					if err := assign(cmd); err != nil {
-						fmt.Printf("Error, %s.\n", err.Error())
-					}
-					continue
-				}
-
-				if err := expr(cmd); err != nil {
-					fmt.Printf("Error, %s.\n", err.Error())
-				}
 			}
 		} else if err == liner.ErrPromptAborted || err == io.EOF {
 			fmt.Println()
@@ -155,6 +205,133 @@ func runShell() {
 	}
 }
 
+// execute runs one shell command. It returns false if the shell should exit.
+func execute(cmd string) bool {
+	start := time.Now()
+	defer func() { audit(cmd, start) }()
+	if cmd != "result" {
+		lastResult = nil
+	}
+	if stmt, ok := aliases[cmd]; ok {
+		cmd = stmt
+	}
+	switch cmd {
+	case "?", "help":
+		printHelp()
+	case "clear":
+		workspace = map[string]*GoroutineDump{}
+		lastPager = nil
+		undoStack, redoStack = nil, nil
+		fmt.Println("Workspace cleared.")
+	case "exit", "quit":
+		return false
+	case "ls":
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Println(err)
+			return true
+		}
+		printDir(wd)
+	case "next", "prev":
+		if err := page(cmd); err != nil {
+			reportError(err)
+		}
+	case "result":
+		printResult()
+	case "undo", "redo":
+		if err := undo(cmd == "redo"); err != nil {
+			reportError(err)
+		}
+	case "pwd":
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Println(err)
+			return true
+		}
+		fmt.Println(wd)
+	case "whos":
+		if len(workspace) == 0 {
+			fmt.Println("No variables defined.")
+			return true
+		}
+		for k := range workspace {
+			fmt.Printf("%s\t", k)
+		}
+		fmt.Println()
+	default:
+		if strings.HasPrefix(cmd, "!") {
+			if err := runShellCommand(cmd); err != nil {
+				reportError(err)
+			}
+			return true
+		}
+
+		if setPattern.MatchString(cmd) {
+			if err := set(cmd); err != nil {
+				reportError(err)
+			}
+			return true
+		}
+
+		if deffilterPattern.MatchString(cmd) {
+			if err := deffilter(cmd); err != nil {
+				reportError(err)
+			}
+			return true
+		}
+
+		if cdPattern.MatchString(cmd) {
+			// Change directory.
+			idx := strings.Index(cmd, "cd")
+			dir := strings.TrimSpace(cmd[idx+2:])
+			if dir == "" {
+				fmt.Println("Expect command \"cd <dir>\"")
+				return true
+			}
+			if err := os.Chdir(dir); err != nil {
+				fmt.Println(err)
+			}
+			return true
+		}
+
+		cmd = quoteFilterRefs(cmd)
+
+		timed(cmd, func() {
+			run := expr
+			if assignPattern.MatchString(cmd) {
+				run = assign
+			}
+			interruptibly(func() {
+				if err := run(cmd); err != nil {
+					reportError(err)
+				}
+			})
+		})
+	}
+	return true
+}
+
+// interruptible returns a context canceled by Ctrl-C, so that a long running
+// command can be stopped without exiting the shell.
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// statementCtx is the context of the statement running, canceled by Ctrl-C.
+// The long running steps of statements, such as loading a dump or evaluating
+// a condition over it, stop once it's done.
+var statementCtx = context.Background()
+
+// interruptibly runs the statement with statementCtx canceled by Ctrl-C
+// rather than the shell terminated, so that the workspace is kept.
+func interruptibly(run func()) {
+	ctx, stop := interruptible()
+	defer stop()
+	statementCtx = ctx
+	defer func() { statementCtx = context.Background() }()
+	run()
+}
+
 func printDir(wd string) {
 	f, err := os.Open(wd)
 	if err != nil {
@@ -191,18 +368,66 @@ func printHelp() {
 	fmt.Println("Statements:")
 	fmt.Println("\t<var>")
 	fmt.Println("\t<var> = load(\"<file-name>\")")
+	fmt.Println("\t<var> = load(\"<file-name>\", \"<another-file-name>\", ...)")
+	fmt.Println("\t<var> = merge(<var>, <another-var>, ...)")
+	fmt.Println("\t<var> = capture(\"<shell-command>\")")
+	fmt.Println("\t<var> = attach(pid)")
+	fmt.Println("\t<var> = attach(pid, \"sigquit\")")
 	fmt.Println("\t<var> = <another-var>")
 	fmt.Println("\t<var> = <another-var>.copy()")
 	fmt.Println("\t<var> = <another-var>.copy(\"<condition>\")")
+	fmt.Println("\t<var>.assert(\"<assertion>\")")
+	fmt.Println("\t<var>.contention(\"<block-or-mutex-profile>\")")
+	fmt.Println("\t<var>.count(\"<condition>\")")
 	fmt.Println("\t<var>.delete(\"<condition>\")")
+	fmt.Println("\t<var>.delete(\"<condition>\", \"dry-run\")")
+	fmt.Println("\tyes, no = <var>.partition(\"<condition>\")")
+	fmt.Println("\t<var>.expand(id)")
+	fmt.Println("\t<var>.explain()")
 	fmt.Println("\tleft = <var>.diff(<another-var>)")
 	fmt.Println("\tleft, common = <var>.diff(<another-var>)")
 	fmt.Println("\tleft, common, right = <var>.diff(<another-var>)")
+	fmt.Println("\t<var>.groupby(\"<field>\")")
 	fmt.Println("\t<var>.keep(\"<condition>\")")
+	fmt.Println("\t<var>.keep(\"<condition>\", \"dry-run\")")
+	fmt.Println("\t<var>.keepstate(\"<state>\")")
+	fmt.Println("\t<var>.newer_than(minutes)")
+	fmt.Println("\t<var>.note(\"<text>\")")
+	fmt.Println("\t<var>.note(id, \"<text>\")")
+	fmt.Println("\t<var>.notes()")
+	fmt.Println("\t<var>.older_than(minutes)")
+	fmt.Println("\t<var>.requests()")
 	fmt.Println("\t<var>.save(\"<output-file-name>\")")
+	fmt.Println("\t<var>.save(\"<output-file-name>\", \"raw\")")
+	fmt.Println("\t<var>.save_pprof(\"<output-file-name>\")")
 	fmt.Println("\t<var>.search(\"<condition>\")")
 	fmt.Println("\t<var>.search(\"<condition>\", offset)")
 	fmt.Println("\t<var>.search(\"<condition>\", offset, limit)")
+	fmt.Println("\t<var>.search(\"<pattern>\")")
 	fmt.Println("\t<var>.show()")
+	fmt.Println("\t<var>.show(offset)")
+	fmt.Println("\t<var>.show(offset, limit)")
+	fmt.Println("\t<var>.show_tag(\"<tag>\")")
+	fmt.Println("\t<var>.stats()")
+	fmt.Println("\t<var>.strip(\"<pattern>\")")
+	fmt.Println("\t<var>.summary_by_origin()")
+	fmt.Println("\t<var>.summary_by_origin(\"signatures\")")
+	fmt.Println("\t<var>.symbolize()")
+	fmt.Println("\t<var>.stuck(minutes)")
+	fmt.Println("\t<var>.tag(\"<condition>\", \"<tag>\")")
+	fmt.Println("\t<var>.truncate(depth)")
+	fmt.Println("\tstats()")
+	fmt.Println("\tarchive(\"<output-file-name>\")")
+	fmt.Println("\tunarchive(\"<archive-file-name>\")")
+	fmt.Println("\tsummary_all()")
+	fmt.Println("\tsummary_all(\"signatures\")")
+	fmt.Println("\tcheck(\"<condition>\")")
+	fmt.Println("\ttrack(id)")
+	fmt.Println("\ttrack(id, <var>, <another-var>, ...)")
+	fmt.Println("\tplugin(\"<starlark-file>\")")
+	fmt.Println("\treport_md(\"<output-file-name>\", <var>)")
+	fmt.Println("\treport_md(\"<output-file-name>\", <before-var>, <after-var>)")
+	fmt.Println("\tleaks(<before-var>, <after-var>)")
+	fmt.Println("\tleaks(<before-var>, <after-var>, limit)")
 	fmt.Println()
 }
@@ -0,0 +1,66 @@
+package main
+
+import "sort"
+
+// matrixMaxSignatures limits the rows of a summary matrix by signature.
+const matrixMaxSignatures = 10
+
+// SummaryMatrix counts the goroutines of several dumps by row, a state class
+// or a stack signature, with a column per dump.
+type SummaryMatrix struct {
+	Rows   []string
+	Counts [][]int // Counts[row][dump], duplicates included.
+	Totals []int
+}
+
+// SummaryAll builds the summary matrix of the dumps by state class, or by
+// stack signature for the largest ones if bySignature is true.
+func SummaryAll(dumps []*GoroutineDump, bySignature bool) SummaryMatrix {
+	m := SummaryMatrix{Totals: make([]int, len(dumps))}
+	counts := map[string][]int{}
+	labels := map[string]string{}
+	for i, gd := range dumps {
+		for _, g := range gd.goroutines {
+			key := stateClass(g.metas[MetaState])
+			if bySignature {
+				key = g.scrubbedHash
+				if _, ok := labels[key]; !ok {
+					labels[key] = g.leafFunc()
+				}
+			}
+			if counts[key] == nil {
+				counts[key] = make([]int, len(dumps))
+			}
+			counts[key][i] += g.weight()
+			m.Totals[i] += g.weight()
+		}
+	}
+
+	keys := make([]string, 0, len(counts))
+	sums := map[string]int{}
+	for k, cs := range counts {
+		keys = append(keys, k)
+		for _, n := range cs {
+			sums[k] += n
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if sums[keys[i]] != sums[keys[j]] {
+			return sums[keys[i]] > sums[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if bySignature && len(keys) > matrixMaxSignatures {
+		keys = keys[:matrixMaxSignatures]
+	}
+
+	for _, k := range keys {
+		row := k
+		if bySignature {
+			row = labels[k]
+		}
+		m.Rows = append(m.Rows, row)
+		m.Counts = append(m.Counts, counts[k])
+	}
+	return m
+}
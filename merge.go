@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Merge combines the dumps, e.g. taken from several replicas, into one. Its
+// goroutines are labeled with the origin of the dump they come from, the
+// "origin" field in conditionals, except those merged before which keep
+// theirs. Goroutine ids aren't unique in the merged dump.
+func Merge(origins []string, dumps []*GoroutineDump) *GoroutineDump {
+	merged := NewGoroutineDump()
+	for i, gd := range dumps {
+		for _, g := range gd.goroutines {
+			merged.Add(withOrigin(g, origins[i]))
+		}
+		for _, n := range gd.notes {
+			merged.notes = append(merged.notes, fmt.Sprintf("%s: %s", origins[i], n))
+		}
+		merged.parseTime += gd.parseTime
+	}
+	return merged
+}
+
+// withOrigin returns a copy of the goroutine labeled with origin, leaving the
+// goroutine itself, which may be shared by other dumps, as it is.
+func withOrigin(g *Goroutine, origin string) *Goroutine {
+	c := *g
+	if c.origin == "" {
+		c.origin = origin
+	}
+	if len(g.members) > 0 {
+		c.members = make([]*Goroutine, len(g.members))
+		for i, m := range g.members {
+			c.members[i] = withOrigin(m, origin)
+		}
+	}
+	return &c
+}
+
+// skewRatio is how many times the median count an origin must hold to be
+// reported as skewed.
+const skewRatio = 2
+
+// units returns the goroutines of the dump, with the deduped groups split
+// into their members, which may come from different origins.
+func (gd GoroutineDump) units() []*Goroutine {
+	units := make([]*Goroutine, 0, len(gd.goroutines))
+	for _, g := range gd.goroutines {
+		if len(g.members) > 0 {
+			units = append(units, g.members...)
+		} else {
+			units = append(units, g)
+		}
+	}
+	return units
+}
+
+// ByOrigin splits a merged dump by origin, in the order the origins first
+// appear. Goroutines not merged from anywhere are under "".
+func (gd GoroutineDump) ByOrigin() ([]string, []*GoroutineDump) {
+	var origins []string
+	dumps := map[string]*GoroutineDump{}
+	for _, g := range gd.units() {
+		d, ok := dumps[g.origin]
+		if !ok {
+			d = NewGoroutineDump()
+			dumps[g.origin] = d
+			origins = append(origins, g.origin)
+		}
+		d.Add(g)
+	}
+
+	split := make([]*GoroutineDump, len(origins))
+	for i, o := range origins {
+		split[i] = dumps[o]
+	}
+	return origins, split
+}
+
+// GroupBy counts the goroutines, duplicates included, by the value of field,
+// one of the fields of conditionals other than trace and tags.
+func (gd GoroutineDump) GroupBy(field string) (map[string]int, error) {
+	get, ok := conditionFields[field]
+	if !ok || field == "trace" || field == "tags" {
+		return nil, fmt.Errorf("cannot group by %s", field)
+	}
+	counts := map[string]int{}
+	for _, g := range gd.units() {
+		counts[fmt.Sprint(get(g))] += g.weight()
+	}
+	return counts, nil
+}
+
+// skewed returns the ratio of each count to the median count, the lower one
+// for an even number of counts, for those holding skewRatio times the median
+// or more.
+func skewed(counts map[string]int) map[string]float64 {
+	if len(counts) < 2 {
+		return nil
+	}
+	ns := make([]int, 0, len(counts))
+	for _, n := range counts {
+		ns = append(ns, n)
+	}
+	sort.Ints(ns)
+	median := float64(ns[(len(ns)-1)/2])
+
+	ratios := map[string]float64{}
+	for k, n := range counts {
+		if r := float64(n) / median; median > 0 && r >= skewRatio {
+			ratios[k] = r
+		}
+	}
+	return ratios
+}
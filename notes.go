@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// entry returns the goroutine of the dump holding the goroutine id, which is
+// the representative of its group once deduped, or nil if it's not found.
+func (gd GoroutineDump) entry(id int) *Goroutine {
+	for _, g := range gd.goroutines {
+		for _, m := range g.originals() {
+			if m.id == id {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+// Note attaches a free-text note to the dump.
+func (gd *GoroutineDump) Note(text string) error {
+	text = strings.TrimSpace(strings.Trim(text, "\""))
+	if text == "" {
+		return fmt.Errorf("empty note")
+	}
+	gd.notes = append(gd.notes[:len(gd.notes):len(gd.notes)], text)
+	return nil
+}
+
+// NoteGoroutine attaches a free-text note to the goroutine id, or to its
+// group if it has been deduped.
+func (gd *GoroutineDump) NoteGoroutine(id int, text string) error {
+	text = strings.TrimSpace(strings.Trim(text, "\""))
+	if text == "" {
+		return fmt.Errorf("empty note")
+	}
+	g := gd.entry(id)
+	if g == nil {
+		return fmt.Errorf("goroutine %d not found", id)
+	}
+	// Never append in place, like tags.
+	g.notes = append(g.notes[:len(g.notes):len(g.notes)], text)
+	return nil
+}
+
+// Noted returns the goroutines having notes.
+func (gd GoroutineDump) Noted() []*Goroutine {
+	var found []*Goroutine
+	for _, g := range gd.goroutines {
+		if len(g.notes) > 0 {
+			found = append(found, g)
+		}
+	}
+	return found
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// pager remembers the last show() or search(), so that "next" and "prev" can
+// move through its pages.
+type pager struct {
+	show   func(offset, limit int) (int, error) // Prints a page, returns the total.
+	offset int
+	limit  int
+	total  int
+}
+
+var lastPager *pager
+
+// paginate prints the page at offset, and makes it the one "next" and "prev"
+// move from.
+func paginate(show func(offset, limit int) (int, error), offset, limit int) error {
+	p := &pager{show: show, limit: limit}
+	if err := p.turn(offset); err != nil {
+		return err
+	}
+	lastPager = p
+	return nil
+}
+
+func (p *pager) turn(offset int) error {
+	total, err := p.show(offset, p.limit)
+	if err != nil {
+		return err
+	}
+	p.offset, p.total = offset, total
+	return nil
+}
+
+// page handles the "next" and "prev" commands.
+func page(cmd string) error {
+	p := lastPager
+	if p == nil {
+		return errors.New("nothing to page through, run show() or search() first")
+	}
+	switch cmd {
+	case "next":
+		if p.offset+p.limit >= p.total {
+			return errors.New("already at the last page")
+		}
+		return p.turn(p.offset + p.limit)
+	case "prev":
+		if p.offset == 0 {
+			return errors.New("already at the first page")
+		}
+		offset := p.offset - p.limit
+		if offset < 0 {
+			offset = 0
+		}
+		return p.turn(offset)
+	}
+	return fmt.Errorf("unknown command %s", cmd)
+}
+
+// pageArgs parses the optional offset and limit arguments of show() and
+// search(), 0 and 10 by default. show() without arguments shows all the
+// goroutines instead.
+func pageArgs(args []ast.Expr) (offset, limit int, err error) {
+	offset, limit = 0, 10
+	if len(args) > 0 {
+		if offset, err = intArg(args[0]); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid argument 'offset' %s", exprString(args[0]))
+		}
+	}
+	if len(args) > 1 {
+		if limit, err = intArg(args[1]); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("invalid argument 'limit' %s", exprString(args[1]))
+		}
+	}
+	return offset, limit, nil
+}
+
+// intArg returns the value of an integer literal argument, negative ones
+// included.
+func intArg(arg ast.Expr) (int, error) {
+	sign := 1
+	if u, ok := arg.(*ast.UnaryExpr); ok && u.Op == token.SUB {
+		sign, arg = -1, u.X
+	}
+	lit, ok := arg.(*ast.BasicLit)
+	if !ok || lit.Kind != token.INT {
+		return 0, errors.New("expect an integer")
+	}
+	n, err := strconv.Atoi(lit.Value)
+	return sign * n, err
+}
+
+// exprString returns the source of an argument for error messages.
+func exprString(arg ast.Expr) string {
+	var sb strings.Builder
+	printer.Fprint(&sb, token.NewFileSet(), arg)
+	return sb.String()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	"go.starlark.net/starlark"
+)
+
+// pluginFunctions maps the functions defined by plugins to their files.
+var pluginFunctions = map[string]string{}
+
+// loadPlugin executes the Starlark file fn and registers its global functions
+// for use in conditionals. Functions whose names start with "_" are private to
+// the file. It returns the names registered.
+func loadPlugin(fn string) ([]string, error) {
+	fn = strings.Trim(fn, "\"")
+	globals, err := starlark.ExecFile(&starlark.Thread{Name: fn}, fn, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Conditions are evaluated concurrently, the functions must not change
+	// the globals.
+	globals.Freeze()
+
+	var names []string
+	for name, v := range globals {
+		sf, ok := v.(*starlark.Function)
+		if !ok || strings.HasPrefix(name, "_") {
+			continue
+		}
+		if _, ok := functions[name]; ok && pluginFunctions[name] == "" {
+			return nil, fmt.Errorf("%s: cannot override builtin function %s()", fn, name)
+		}
+		names = append(names, name)
+		functions[name] = starlarkFunction(sf)
+		pluginFunctions[name] = fn
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// loadPlugins loads all the "*.star" files in dir.
+func loadPlugins(dir string) {
+	fns, err := filepath.Glob(filepath.Join(dir, "*.star"))
+	if err != nil {
+		return
+	}
+	for _, fn := range fns {
+		if _, err := loadPlugin(fn); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading plugin %s.\n", err)
+		}
+	}
+}
+
+// starlarkFunction adapts a Starlark function to a conditional function.
+func starlarkFunction(sf *starlark.Function) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		sargs := make(starlark.Tuple, 0, len(args))
+		for _, arg := range args {
+			sarg, err := toStarlark(arg)
+			if err != nil {
+				return nil, fmt.Errorf("%s(): %s", sf.Name(), err)
+			}
+			sargs = append(sargs, sarg)
+		}
+
+		// A Thread must not be shared by concurrent calls.
+		res, err := starlark.Call(&starlark.Thread{Name: sf.Name()}, sf, sargs, nil)
+		if err != nil {
+			return nil, err
+		}
+		return fromStarlark(res)
+	}
+}
+
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case string:
+		return starlark.String(v), nil
+	case int:
+		return starlark.MakeInt(v), nil
+	case float64:
+		// Numbers in conditionals are float64, pass integers as such.
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	}
+	return nil, fmt.Errorf("unsupported argument type %T", v)
+}
+
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("integer %s out of range", v)
+		}
+		return float64(i), nil
+	case starlark.Float:
+		return float64(v), nil
+	}
+	return nil, fmt.Errorf("unsupported return type %s", v.Type())
+}
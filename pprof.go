@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// Profile converts the dump to a pprof goroutine profile, one sample per
+// goroutine weighted by its number of duplicates. The "created by" frames are
+// left out, like in the profiles of the Go runtime.
+func (gd GoroutineDump) Profile() *profile.Profile {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "goroutine", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "goroutine", Unit: "count"},
+		Period:     1,
+	}
+
+	functions := map[[2]string]*profile.Function{}
+	locations := map[string]*profile.Location{}
+	location := func(addr uint64, name, file string, line int64) *profile.Location {
+		key := strconv.FormatUint(addr, 16) + "\x00" + name + "\x00" + file + "\x00" + strconv.FormatInt(line, 10)
+		if loc, ok := locations[key]; ok {
+			return loc
+		}
+		fn, ok := functions[[2]string{name, file}]
+		if !ok {
+			fn = &profile.Function{ID: uint64(len(p.Function) + 1), Name: name, SystemName: name, Filename: file}
+			functions[[2]string{name, file}] = fn
+			p.Function = append(p.Function, fn)
+		}
+		loc := &profile.Location{
+			ID:      uint64(len(p.Location) + 1),
+			Address: addr,
+			Line:    []profile.Line{{Function: fn, Line: line}},
+		}
+		locations[key] = loc
+		p.Location = append(p.Location, loc)
+		return loc
+	}
+
+	for _, g := range gd.goroutines {
+		if g.external {
+			continue
+		}
+		s := &profile.Sample{Value: []int64{int64(g.weight())}}
+		if state := g.metas[MetaState]; state != "" {
+			s.Label = map[string][]string{"state": {state}}
+		}
+		for _, f := range splitStack(g.buf.String()).frames {
+			addr, name, file, line := parseFrame(f)
+			s.Location = append(s.Location, location(addr, name, file, line))
+		}
+		p.Sample = append(p.Sample, s)
+	}
+	return p
+}
+
+// parseFrame returns the pc, function, file and line of a frame of either the
+// debug=1 or the debug=2 format, as far as they are known.
+func parseFrame(f []string) (addr uint64, name, file string, line int64) {
+	name = funcName(f[0])
+	loc := ""
+	if strings.HasPrefix(f[0], "#\t") {
+		// #	0x4dea98	main.worker+0x18	/app/main.go:10
+		parts := strings.Split(f[0], "\t")
+		addr, _ = strconv.ParseUint(strings.TrimPrefix(parts[1], "0x"), 16, 64)
+		if len(parts) > 3 {
+			// The locations are aligned with several tabs.
+			loc = parts[len(parts)-1]
+		}
+	} else if len(f) > 1 {
+		//	/app/main.go:10 +0x37
+		loc = strings.TrimSpace(f[1])
+		if idx := strings.LastIndex(loc, " +0x"); idx > 0 {
+			loc = loc[:idx]
+		}
+	}
+	if idx := strings.LastIndex(loc, ":"); idx > 0 {
+		file = loc[:idx]
+		line, _ = strconv.ParseInt(loc[idx+1:], 10, 64)
+	}
+	return addr, name, file, line
+}
+
+// SavePprof saves the dump to the given file as a gzipped pprof protobuf, for
+// "go tool pprof".
+func (gd GoroutineDump) SavePprof(fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := gd.Profile().Write(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
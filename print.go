@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sgr "github.com/foize/go.sgr"
+)
+
+func printGoroutines(gs []*Goroutine, re *regexp.Regexp) {
+	for _, g := range gs {
+		g.PrintWithHighlight(re)
+	}
+}
+
+// progressThreshold is the size of the text of a dump above which loading
+// shows progress.
+const progressThreshold = 16 << 20
+
+// printProgress returns a loadContext progress callback printing the
+// percentage parsed of large dumps, and a function to clear it when done.
+func printProgress(fn string) (func(parsed, size int64), func()) {
+	fn = strings.Trim(fn, "\"")
+	last := -1
+	progress := func(parsed, size int64) {
+		if size < progressThreshold {
+			return
+		}
+		if pct := int(parsed * 100 / size); pct != last {
+			last = pct
+			fmt.Fprintf(os.Stderr, "\rLoading %s: %3d%% (Ctrl-C to cancel)", fn, pct)
+		}
+	}
+	done := func() {
+		if last >= 0 {
+			fmt.Fprint(os.Stderr, "\r\033[K")
+		}
+	}
+	return progress, done
+}
+
+// maxWarnings is the number of parse warnings listed after loading a dump.
+const maxWarnings = 10
+
+func printWarnings(gd *GoroutineDump) {
+	warnings := gd.Warnings()
+	if len(warnings) == 0 {
+		return
+	}
+	sgr.Printf("[fg-yellow]%d problems found while loading:[reset]\n", len(warnings))
+	for i, w := range warnings {
+		if i == maxWarnings {
+			fmt.Printf("  ... and %d more\n", len(warnings)-maxWarnings)
+			break
+		}
+		fmt.Printf("  line %d: %s\n", w.Line, w.Reason)
+	}
+	fmt.Println()
+}
+
+func printNotes(gd *GoroutineDump) {
+	noted := gd.Noted()
+	if len(gd.notes) == 0 && len(noted) == 0 {
+		fmt.Println("No notes.")
+		return
+	}
+	for _, n := range gd.notes {
+		sgr.Printf("[fg-yellow]# %s[reset]\n", n)
+	}
+	if len(gd.notes) > 0 {
+		fmt.Println()
+	}
+	printGoroutines(noted, nil)
+}
+
+func printSummary(gd *GoroutineDump) {
+	summary := gd.Summary()
+	for _, n := range gd.notes {
+		sgr.Printf("[fg-yellow]# %s[reset]\n", n)
+	}
+	fmt.Printf("# of goroutines: %d\n", summary.Total)
+	if summary.Total > 0 {
+		fmt.Println()
+	}
+	if len(summary.States) > 0 {
+		states := make([]string, 0, len(summary.States))
+		for k := range summary.States {
+			states = append(states, k)
+		}
+		sort.Strings(states)
+
+		for _, k := range states {
+			fmt.Printf("%15s: %d\n", k, summary.States[k])
+		}
+		fmt.Println()
+	}
+	if g := summary.Longest; g != nil {
+		fmt.Printf("Longest wait: %s", formatMinutes(g.duration))
+		if since := waitingSince(g.duration); since != "" {
+			fmt.Printf(" since %s", since)
+		}
+		fmt.Printf(", goroutine %d [%s]\n\n", g.id, g.metas[MetaState])
+	}
+	printTop("State classes", summary.Classes)
+	printTop("Top packages", summary.Packages)
+	printTop("Top creators", summary.Creators)
+}
+
+func printLeaks(suspects []LeakSuspect, limit int) {
+	if len(suspects) == 0 {
+		fmt.Println("No stack signature grew.")
+		return
+	}
+
+	growth := 0
+	for _, s := range suspects {
+		growth += s.Growth
+	}
+	sgr.Printf("[fg-green]%d stack signatures grew by %d goroutines in total.[reset]\n\n", len(suspects), growth)
+
+	for i, s := range suspects {
+		if i == limit {
+			fmt.Printf("... %d more\n", len(suspects)-limit)
+			break
+		}
+		ratio := "new"
+		if !math.IsInf(s.Ratio, 1) {
+			ratio = fmt.Sprintf("x%.1f", s.Ratio)
+		}
+		sgr.Printf("[fg-red]#%d[reset] %d -> %d (+%d, %s)\n", i+1, s.Before, s.After, s.Growth, ratio)
+		s.Sample.PrintWithColor()
+	}
+}
+
+// maxTop is the number of entries listed by printTop.
+const maxTop = 10
+
+// printStuck prints the groups of goroutines waiting for minutes or more, by
+// the function which created them.
+func printStuck(stuck []StuckGroup, total, minutes int) {
+	if total == 0 {
+		fmt.Printf("No goroutine waited for %d minutes or more.\n", minutes)
+		return
+	}
+	sgr.Printf("[fg-green]%d goroutines waited for %d minutes or more, by creator:[reset]\n\n", total, minutes)
+	fmt.Printf("%7s  %7s  %s\n", "count", "longest", "creator")
+	for _, sg := range stuck {
+		fmt.Printf("%7d  %7s  %s\n", sg.Count, formatMinutes(sg.Longest), sg.Creator)
+	}
+}
+
+func printExplanations(explained []Explanation, unexplained, signatures int) {
+	total := unexplained
+	for _, e := range explained {
+		total += e.Count
+	}
+	sgr.Printf("[fg-green]Explained %d of %d goroutines.[reset]\n\n", total-unexplained, total)
+	for _, e := range explained {
+		fmt.Printf("%7d  %s\n", e.Count, e.Text)
+	}
+	if unexplained > 0 {
+		fmt.Printf("%7d  unexplained, in %d stack signatures\n", unexplained, signatures)
+	}
+}
+
+func printGroupDeltas(deltas []GroupDelta) {
+	unchanged := 0
+	for _, d := range deltas {
+		if d.Before == d.After {
+			unchanged++
+		}
+	}
+	sgr.Printf("[fg-green]%d common stack signatures, %d changed in size.[reset]\n\n", len(deltas), len(deltas)-unchanged)
+	if unchanged == len(deltas) {
+		return
+	}
+
+	fmt.Printf("%7s  %7s  %7s  %s\n", "before", "after", "delta", "goroutine")
+	for _, d := range deltas {
+		if d.Before == d.After {
+			continue
+		}
+		fmt.Printf("%7d  %7d  %+7d  %d %s\n", d.Before, d.After, d.After-d.Before, d.Sample.id, d.Sample.leafFunc())
+	}
+}
+
+func printSummaryMatrix(names []string, m SummaryMatrix) {
+	width := len("total")
+	for _, r := range m.Rows {
+		if len(r) > width {
+			width = len(r)
+		}
+	}
+	colWidths := make([]int, len(names))
+	for i, n := range names {
+		colWidths[i] = len(n)
+		if colWidths[i] < 7 {
+			colWidths[i] = 7
+		}
+	}
+
+	printRow := func(label string, cells []string) {
+		fmt.Printf("%-*s", width, label)
+		for i, c := range cells {
+			fmt.Printf("  %*s", colWidths[i], c)
+		}
+		fmt.Println()
+	}
+	counts := func(ns []int) []string {
+		cells := make([]string, len(ns))
+		for i, n := range ns {
+			cells[i] = strconv.Itoa(n)
+		}
+		return cells
+	}
+
+	printRow("", names)
+	for i, r := range m.Rows {
+		printRow(r, counts(m.Counts[i]))
+	}
+	printRow("total", counts(m.Totals))
+}
+
+func printTrack(id int, names []string, points []TrackPoint) {
+	nameWidth, stateWidth := len("dump"), len("state")
+	for i, p := range points {
+		if len(names[i]) > nameWidth {
+			nameWidth = len(names[i])
+		}
+		if len(p.State) > stateWidth {
+			stateWidth = len(p.State)
+		}
+	}
+
+	sgr.Printf("[fg-green]Goroutine %d over %d dumps.[reset]\n\n", id, len(points))
+	fmt.Printf("%-*s  %-*s  %8s  %s\n", nameWidth, "dump", stateWidth, "state", "duration", "top frame")
+	for i, p := range points {
+		if !p.Found {
+			fmt.Printf("%-*s  -\n", nameWidth, names[i])
+			continue
+		}
+		fmt.Printf("%-*s  %-*s  %8s  %s", nameWidth, names[i], stateWidth, p.State, formatMinutes(p.Duration), p.Frame)
+		if p.Rewound {
+			sgr.Printf("  [fg-red]<- duration went back, another process?[reset]")
+		} else if p.Changed {
+			sgr.Printf("  [fg-yellow]<- changed[reset]")
+		}
+		fmt.Println()
+	}
+}
+
+func printContention(spots []*Contention, marked map[string]int, limit int) {
+	total := 0
+	for _, n := range marked {
+		total += n
+	}
+	sgr.Printf("[fg-green]%d contention hot spots, %d goroutines blocked in them.[reset]\n\n", len(spots), total)
+	if len(spots) == 0 {
+		return
+	}
+	fmt.Printf("%10s  %8s  %10s  %s\n", "delay", "events", "goroutines", "function")
+	for i, c := range spots {
+		if i == limit {
+			fmt.Printf("... %d more\n", len(spots)-limit)
+			break
+		}
+		fmt.Printf("%10s  %8d  %10d  %s\n", c.Delay.Round(time.Millisecond), c.Count, marked[c.Function], c.Function)
+	}
+}
+
+// printTop prints the entries with the highest counts.
+func printTop(title string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	fmt.Printf("%s:\n", title)
+	for i, k := range keys {
+		if i == maxTop {
+			fmt.Printf("%7s  ... %d more\n", "", len(keys)-maxTop)
+			break
+		}
+		fmt.Printf("%7d  %s\n", counts[k], k)
+	}
+	fmt.Println()
+}
+
+func printStats(name string, gd *GoroutineDump) {
+	stats := gd.Stats()
+	fmt.Printf("%s:\n", name)
+	if stats.ParseTime > 0 {
+		fmt.Printf("%15s: %v\n", "parse time", stats.ParseTime)
+	}
+	fmt.Printf("%15s: %d\n", "goroutines", stats.Goroutines)
+	fmt.Printf("%15s: %d\n", "signatures", stats.Signatures)
+	fmt.Printf("%15s: %d\n", "frames", stats.Frames)
+	if stats.Goroutines > 0 {
+		fmt.Printf("%15s: %d frames (goroutine %d)\n", "deepest stack", stats.MaxDepth, stats.MaxDepthID)
+	}
+	fmt.Printf("%15s: %s\n", "memory", formatBytes(uint64(stats.Bytes)))
+	fmt.Println()
+}
+
+func printMemStats() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	fmt.Printf("%15s: %s\n", "heap in use", formatBytes(ms.HeapInuse))
+	fmt.Printf("%15s: %s\n", "from system", formatBytes(ms.Sys))
+	fmt.Println()
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func printGroups(field string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	total := 0
+	for k, n := range counts {
+		keys = append(keys, k)
+		total += n
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	var ratios map[string]float64
+	if field == "origin" {
+		ratios = skewed(counts)
+	}
+	sgr.Printf("[fg-green]%d goroutines in %d groups by %s.[reset]\n\n", total, len(keys), field)
+	for i, k := range keys {
+		if i == maxTop {
+			fmt.Printf("%7s  ... %d more\n", "", len(keys)-maxTop)
+			break
+		}
+		label := k
+		if label == "" {
+			label = "(none)"
+		}
+		fmt.Printf("%7d  %5.1f%%  %s", counts[k], float64(counts[k])*100/float64(total), label)
+		if r, ok := ratios[k]; ok {
+			sgr.Printf("  [fg-red]<- x%.1f the median[reset]", r)
+		}
+		fmt.Println()
+	}
+}
+
+// printSkew prints the origins holding far more goroutines than the others.
+func printSkew(names []string, totals []int) {
+	counts := make(map[string]int, len(names))
+	for i, n := range names {
+		counts[n] = totals[i]
+	}
+	ratios := skewed(counts)
+	if len(ratios) == 0 {
+		return
+	}
+	fmt.Println()
+	for _, n := range names {
+		if r, ok := ratios[n]; ok {
+			sgr.Printf("[fg-red]%s holds x%.1f the goroutines of the median origin.[reset]\n", n, r)
+		}
+	}
+}
+
+func printRequests(groups []RequestGroup) {
+	if len(groups) == 0 {
+		fmt.Println("No in-flight HTTP or gRPC requests found.")
+		return
+	}
+	requests, outbound, started := 0, 0, 0
+	for _, rg := range groups {
+		requests += rg.Requests
+		outbound += rg.Outbound
+		started += rg.Goroutines
+	}
+	sgr.Printf("[fg-green]%d in-flight requests, %d waiting on outbound calls, %d more goroutines started for them.[reset]\n\n", requests, outbound, started)
+	fmt.Printf("%8s  %8s  %10s  %-5s  %s\n", "requests", "outbound", "goroutines", "kind", "handler")
+	for _, rg := range groups {
+		fmt.Printf("%8d  %8d  %10d  %-5s  %s\n", rg.Requests, rg.Outbound, rg.Goroutines, rg.Kind, rg.Handler)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// reportMaxRows limits the rows of the signature tables of a Markdown report.
+const reportMaxRows = 10
+
+// signatureDeltas compares the goroutines by stack signature between the
+// dumps before and after, and returns the signatures which changed in size,
+// appeared or disappeared, the largest absolute change first.
+func signatureDeltas(before, after *GoroutineDump) []GroupDelta {
+	bcounts, bsamples := before.countSignatures()
+	acounts, asamples := after.countSignatures()
+
+	var deltas []GroupDelta
+	for sig, n := range acounts {
+		if b := bcounts[sig]; b != n {
+			deltas = append(deltas, GroupDelta{Before: b, After: n, Sample: asamples[sig]})
+		}
+	}
+	for sig, b := range bcounts {
+		if _, ok := acounts[sig]; !ok {
+			deltas = append(deltas, GroupDelta{Before: b, Sample: bsamples[sig]})
+		}
+	}
+	sortGroupDeltas(deltas)
+	return deltas
+}
+
+// writeReport writes a GitHub-flavored Markdown report of the last of the
+// dumps to w: the goroutines by state class and the largest stack signatures.
+// Given two dumps, the states are compared between them, and the signatures
+// which changed in size are listed as well.
+func writeReport(w io.Writer, names []string, dumps []*GoroutineDump) error {
+	bw := bufio.NewWriter(w)
+	name, gd := names[len(names)-1], dumps[len(dumps)-1]
+	diff := len(dumps) == 2
+
+	if diff {
+		fmt.Fprintf(bw, "## Goroutines of %s compared to %s\n\n", name, names[0])
+	} else {
+		fmt.Fprintf(bw, "## Goroutines of %s\n\n", name)
+	}
+
+	m := SummaryAll(dumps, false)
+	fmt.Fprintln(bw, "### States")
+	fmt.Fprintln(bw)
+	header := append([]string{"state class"}, names...)
+	align := "| --- |" + strings.Repeat(" ---: |", len(names))
+	if diff {
+		header = append(header, "delta")
+		align += " ---: |"
+	}
+	fmt.Fprintf(bw, "| %s |\n%s\n", strings.Join(header, " | "), align)
+	row := func(label string, counts []int) {
+		fmt.Fprintf(bw, "| %s |", label)
+		for _, n := range counts {
+			fmt.Fprintf(bw, " %d |", n)
+		}
+		if diff {
+			fmt.Fprintf(bw, " %+d |", counts[1]-counts[0])
+		}
+		fmt.Fprintln(bw)
+	}
+	for i, r := range m.Rows {
+		row(r, m.Counts[i])
+	}
+	row("**total**", m.Totals)
+	fmt.Fprintln(bw)
+
+	counts, samples := gd.countSignatures()
+	sigs := make([]string, 0, len(counts))
+	for sig := range counts {
+		sigs = append(sigs, sig)
+	}
+	sort.Slice(sigs, func(i, j int) bool {
+		if counts[sigs[i]] != counts[sigs[j]] {
+			return counts[sigs[i]] > counts[sigs[j]]
+		}
+		return samples[sigs[i]].id < samples[sigs[j]].id
+	})
+	fmt.Fprintf(bw, "### Top stack signatures of %s\n\n", name)
+	fmt.Fprintln(bw, "| goroutines | state | function |")
+	fmt.Fprintln(bw, "| ---: | --- | --- |")
+	for i, sig := range sigs {
+		if i == reportMaxRows {
+			break
+		}
+		g := samples[sig]
+		fmt.Fprintf(bw, "| %d | %s | `%s` |\n", counts[sig], g.metas[MetaState], g.leafFunc())
+	}
+	if len(sigs) > reportMaxRows {
+		fmt.Fprintf(bw, "\n... and %d more signatures.\n", len(sigs)-reportMaxRows)
+	}
+
+	if diff {
+		deltas := signatureDeltas(dumps[0], gd)
+		fmt.Fprintln(bw)
+		fmt.Fprintln(bw, "### Changed stack signatures")
+		fmt.Fprintln(bw)
+		if len(deltas) == 0 {
+			fmt.Fprintln(bw, "No stack signature changed in size.")
+		} else {
+			fmt.Fprintf(bw, "| %s | %s | delta | function |\n", names[0], name)
+			fmt.Fprintln(bw, "| ---: | ---: | ---: | --- |")
+			for i, d := range deltas {
+				if i == reportMaxRows {
+					break
+				}
+				fmt.Fprintf(bw, "| %d | %d | %+d | `%s` |\n", d.Before, d.After, d.After-d.Before, d.Sample.leafFunc())
+			}
+			if len(deltas) > reportMaxRows {
+				fmt.Fprintf(bw, "\n... and %d more signatures.\n", len(deltas)-reportMaxRows)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// saveReport writes the Markdown report of the dumps to the file fn, or to
+// the standard output if fn is "-".
+func saveReport(fn string, names []string, dumps []*GoroutineDump) error {
+	if fn == "-" {
+		return writeReport(os.Stdout, names, dumps)
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := writeReport(f, names, dumps); err != nil {
+		return err
+	}
+	return f.Close()
+}
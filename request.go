@@ -0,0 +1,179 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// serverFrames tell the kind of request a goroutine serves by the
+	// function the server dispatches it to the handler from. HTTP/2
+	// handlers go through serverHandler.ServeHTTP too, so they come first.
+	serverFrames = []struct {
+		kind    string
+		pattern *regexp.Regexp
+	}{
+		{"http2", regexp.MustCompile(`^(net/http\.\(\*http2serverConn\)|golang\.org/x/net/http2\.\(\*serverConn\))\.runHandler$`)},
+		{"http", regexp.MustCompile(`^net/http\.serverHandler\.ServeHTTP$`)},
+		{"grpc", regexp.MustCompile(`^google\.golang\.org/grpc\.\(\*Server\)\.process(Unary|Streaming)RPC$`)},
+	}
+
+	// outboundFrame matches the functions of the HTTP and gRPC clients a
+	// request waits in for a call to another service.
+	outboundFrame = regexp.MustCompile(`^(net/http\.\(\*(Client|Transport|persistConn)\)\.(do|roundTrip)|google\.golang\.org/grpc\.(invoke|newClientStream|\(\*ClientConn\)\.(Invoke|NewStream)|\(\*clientStream\)\.(SendMsg|RecvMsg)))$`)
+
+	// serverPackages are skipped when looking for the handler of a request.
+	serverPackages = []string{"net/http", "golang.org/x/net/http2", "google.golang.org/grpc"}
+
+	creatorIDPattern = regexp.MustCompile(` in goroutine (\d+)$`)
+)
+
+// RequestGroup counts the in-flight requests served by a handler.
+type RequestGroup struct {
+	Kind       string // "http", "http2" or "grpc".
+	Handler    string // The first function outside of the server called to serve them.
+	Requests   int
+	Outbound   int // Requests waiting on an outbound HTTP or gRPC call.
+	Goroutines int // Goroutines started on behalf of the requests, their own excluded.
+}
+
+// request is a goroutine serving a request.
+type request struct {
+	kind, handler string
+	outbound      bool
+}
+
+// Requests finds the goroutines serving HTTP or gRPC requests, and those
+// started on their behalf, which the runtime tells since Go 1.21 by the id of
+// the goroutine in their "created by" frame. A request waits on an outbound
+// call if it or one of those goroutines is in an HTTP or gRPC client. It
+// returns the requests grouped by handler, the largest group first.
+func (gd *GoroutineDump) Requests() []RequestGroup {
+	units := gd.units()
+	requests := map[int]*request{} // By goroutine id.
+	parents := map[int]int{}
+	groups := map[request]*RequestGroup{}
+	var order []*Goroutine
+
+	for _, g := range units {
+		if g.external {
+			continue
+		}
+		st := splitStack(g.buf.String())
+		if len(st.creator) > 0 {
+			if m := creatorIDPattern.FindStringSubmatch(st.creator[0]); m != nil {
+				parents[g.id], _ = strconv.Atoi(m[1])
+			}
+		}
+		r := requestOf(st)
+		if r == nil {
+			continue
+		}
+		rg := groupOf(groups, *r)
+		rg.Requests += g.weight()
+		if g.count > 0 {
+			// The records of debug=1 and debug=0 have no ids to follow.
+			if r.outbound {
+				rg.Outbound += g.weight()
+			}
+			continue
+		}
+		requests[g.id] = r
+		order = append(order, g)
+	}
+
+	// Attribute the goroutines to the request they descend from.
+	for _, g := range units {
+		if g.external || g.count > 0 || requests[g.id] != nil {
+			continue
+		}
+		var r *request
+		seen := map[int]bool{}
+		for id, ok := parents[g.id]; ok && !seen[id]; id, ok = parents[id] {
+			seen[id] = true
+			if r = requests[id]; r != nil {
+				break
+			}
+		}
+		if r == nil {
+			continue
+		}
+		groupOf(groups, *r).Goroutines++
+		if !r.outbound && hasOutboundFrame(splitStack(g.buf.String())) {
+			r.outbound = true
+		}
+	}
+	for _, g := range order {
+		if r := requests[g.id]; r.outbound {
+			groupOf(groups, *r).Outbound++
+		}
+	}
+
+	found := make([]RequestGroup, 0, len(groups))
+	for _, rg := range groups {
+		found = append(found, *rg)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Requests != found[j].Requests {
+			return found[i].Requests > found[j].Requests
+		}
+		if found[i].Kind != found[j].Kind {
+			return found[i].Kind < found[j].Kind
+		}
+		return found[i].Handler < found[j].Handler
+	})
+	return found
+}
+
+// groupOf returns the group of the requests served by the handler of r.
+func groupOf(groups map[request]*RequestGroup, r request) *RequestGroup {
+	key := request{kind: r.kind, handler: r.handler}
+	rg, ok := groups[key]
+	if !ok {
+		rg = &RequestGroup{Kind: r.kind, Handler: r.handler}
+		groups[key] = rg
+	}
+	return rg
+}
+
+// requestOf tells the request the stack serves, or nil if it serves none.
+func requestOf(st *stack) *request {
+	for _, sf := range serverFrames {
+		for i, f := range st.frames {
+			if !sf.pattern.MatchString(funcName(f[0])) {
+				continue
+			}
+			r := &request{kind: sf.kind, handler: "(unknown)", outbound: hasOutboundFrame(st)}
+			// The handler is called by the server, so it's further in.
+			for j := i - 1; j >= 0; j-- {
+				name := funcName(st.frames[j][0])
+				if pkg := pkgName(name); !isServerPackage(pkg) && !isRuntimePackage(pkg) {
+					r.handler = name
+					break
+				}
+			}
+			return r
+		}
+	}
+	return nil
+}
+
+func hasOutboundFrame(st *stack) bool {
+	for _, f := range st.frames {
+		if outboundFrame.MatchString(funcName(f[0])) {
+			return true
+		}
+	}
+	return false
+}
+
+func isServerPackage(pkg string) bool {
+	for _, p := range serverPackages {
+		if pkg == p || strings.HasPrefix(pkg, p+"/") {
+			return true
+		}
+	}
+	return false
+}
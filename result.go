@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Verbosity levels of the statement output.
+const (
+	verbosityQuiet = iota
+	verbosityNormal
+	verbosityVerbose
+)
+
+var (
+	verbosity      = verbosityNormal
+	verbosityNames = []string{"quiet", "normal", "verbose"}
+
+	// lastResult holds the counts reported by the last statement, for the
+	// "result" command. Nil if the statement reported none.
+	lastResult result
+)
+
+// result is the machine-readable outcome of a statement.
+type result map[string]interface{}
+
+func setVerbosity(s string) error {
+	for i, n := range verbosityNames {
+		if s == n {
+			verbosity = i
+			return nil
+		}
+	}
+	return fmt.Errorf("expect quiet, normal or verbose, got %q", s)
+}
+
+// report records the result of a statement, and prints the message for it
+// unless in quiet mode.
+func report(r result, format string, args ...interface{}) {
+	lastResult = r
+	if verbosity > verbosityQuiet {
+		fmt.Printf(format, args...)
+	}
+}
+
+// reportError records and prints the error a statement failed with.
+func reportError(err error) {
+	lastResult = result{"error": err.Error()}
+	fmt.Printf("Error, %s.\n", err.Error())
+}
+
+// timed runs the statement, printing how long it took in verbose mode.
+func timed(cmd string, run func()) {
+	start := time.Now()
+	run()
+	if lastResult != nil {
+		lastResult["statement"] = cmd
+	}
+	if verbosity == verbosityVerbose {
+		fmt.Printf("(%s)\n", time.Since(start).Round(time.Microsecond))
+	}
+}
+
+// printResult prints the result of the last statement as JSON.
+func printResult() {
+	if lastResult == nil {
+		fmt.Println("{}")
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(lastResult); err != nil {
+		fmt.Printf("Error, %s.\n", err.Error())
+	}
+}
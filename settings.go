@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	setPattern = regexp.MustCompile(`^\s*set(\s+.*)?$`)
+
+	// displayMaxFrames limits the frames displayed by show() and search(),
+	// zero for no limit.
+	displayMaxFrames = 0
+
+	// displaySamples is the number of members of a deduped group whose
+	// original stacks show() and search() display below the scrubbed one.
+	displaySamples = 0
+
+	// saveRaw makes save() write the original text by default.
+	saveRaw = false
+
+	options = map[string]option{
+		"audit": {
+			usage: "The file each command is logged to with its counts, 0 for none",
+			get: func() string {
+				if auditPath == "" {
+					return "0"
+				}
+				return auditPath
+			},
+			set: setAudit,
+		},
+		"audit.format": {
+			usage: "The format of the audit log, text to replay or json",
+			get: func() string {
+				if auditJSON {
+					return "json"
+				}
+				return "text"
+			},
+			set: setAuditFormat,
+		},
+		"binary": {
+			usage: "The binary the dumps come from, to resolve the addresses of profiles and the inlined frames of stacks, 0 for none",
+			get: func() string {
+				if binaryPath == "" {
+					return "0"
+				}
+				return binaryPath
+			},
+			set: setBinary,
+		},
+		"capture_time": {
+			usage: "When the dumps were taken, \"2006-01-02 15:04\", 0 if unknown",
+			get: func() string {
+				if captureTime.IsZero() {
+					return "0"
+				}
+				return captureTime.Format("2006-01-02 15:04:05")
+			},
+			set: setCaptureTime,
+		},
+		"display.maxframes": {
+			usage: "Show only the first and last frames of deeper stacks, 0 for all",
+			get:   func() string { return strconv.Itoa(displayMaxFrames) },
+			set:   intSetter(&displayMaxFrames),
+		},
+		"display.samples": {
+			usage: "Show the original stacks of that many members of deduped groups",
+			get:   func() string { return strconv.Itoa(displaySamples) },
+			set:   intSetter(&displaySamples),
+		},
+		"save.mode": {
+			usage: "The default mode of save(), pretty or raw",
+			get: func() string {
+				if saveRaw {
+					return "raw"
+				}
+				return "pretty"
+			},
+			set: func(s string) error {
+				switch s {
+				case "raw", "pretty":
+					saveRaw = s == "raw"
+					return nil
+				}
+				return fmt.Errorf("expect pretty or raw, got %q", s)
+			},
+		},
+		"scrub.closures": {
+			usage: "Hash the closures of a function alike in the dumps loaded next, on or off",
+			get: func() string {
+				if scrubClosures {
+					return "on"
+				}
+				return "off"
+			},
+			set: func(s string) error {
+				switch s {
+				case "on", "off":
+					scrubClosures = s == "on"
+					return nil
+				}
+				return fmt.Errorf("expect on or off, got %q", s)
+			},
+		},
+		"verbosity": {
+			usage: "quiet to print no counts, see \"result\", verbose to time statements",
+			get:   func() string { return verbosityNames[verbosity] },
+			set:   setVerbosity,
+		},
+	}
+)
+
+// option is a setting changeable with the "set" command.
+type option struct {
+	usage string
+	get   func() string
+	set   func(string) error
+}
+
+func intSetter(p *int) func(string) error {
+	return func(s string) error {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 {
+			return fmt.Errorf("expect a non-negative integer, got %q", s)
+		}
+		*p = v
+		return nil
+	}
+}
+
+// set handles "set", "set <name>" and "set <name> <value>" (or
+// "set <name>=<value>").
+func set(cmd string) error {
+	args := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmd), "set"))
+	if args == "" {
+		names := make([]string, 0, len(options))
+		for k := range options {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			fmt.Printf("  %20s = %-8s %s\n", k, options[k].get(), options[k].usage)
+		}
+		return nil
+	}
+
+	var name, value string
+	if idx := strings.IndexAny(args, " \t="); idx > 0 {
+		name, value = args[:idx], strings.Trim(strings.TrimSpace(args[idx+1:]), "\"")
+	} else {
+		name = args
+	}
+
+	opt, ok := options[name]
+	if !ok {
+		return fmt.Errorf("unknown option %s", name)
+	}
+	if value == "" {
+		if strings.ContainsAny(args, " \t=") {
+			return errors.New("expect \"set <name> <value>\"")
+		}
+		fmt.Printf("%s = %s\n", name, opt.get())
+		return nil
+	}
+	return opt.set(value)
+}
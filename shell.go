@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// shellCommand returns the command running cmd with the shell of the
+// platform.
+func shellCommand(ctx context.Context, cmd string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", cmd)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", cmd)
+}
+
+// runShellCommand handles "!<command>", running the command with the
+// terminal as its standard input and output until it exits or Ctrl-C.
+func runShellCommand(cmd string) error {
+	cmd = strings.TrimSpace(strings.TrimPrefix(cmd, "!"))
+	if cmd == "" {
+		return errors.New("expect \"!<command>\"")
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+	c := shellCommand(ctx, cmd)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return c.Run()
+}
+
+// capture runs cmd with the shell and loads its standard output as a dump,
+// e.g. one fetched from a pprof endpoint by curl. The standard error of the
+// command goes to the terminal.
+func capture(cmd string) (*GoroutineDump, error) {
+	ctx, stop := interruptible()
+	defer stop()
+
+	var out bytes.Buffer
+	c := shellCommand(ctx, cmd)
+	c.Stdout, c.Stderr = &out, os.Stderr
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, errLoadCanceled
+		}
+		return nil, fmt.Errorf("%s: %s", cmd, err)
+	}
+
+	start := time.Now()
+	dump, err := parse(&out)
+	if err != nil {
+		return nil, err
+	}
+	if symbols != nil {
+		dump.Symbolize(symbols)
+	}
+	dump.parseTime = time.Since(start)
+	return dump, nil
+}
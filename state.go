@@ -0,0 +1,85 @@
+package main
+
+import "strings"
+
+// The normalized classes of the goroutine states.
+const (
+	classRunning     = "running"
+	classRunnable    = "runnable"
+	classSyscall     = "syscall"
+	classBlockedIO   = "blocked-io"
+	classBlockedLock = "blocked-lock"
+	classBlockedChan = "blocked-chan"
+	classSleeping    = "sleeping"
+	classGC          = "GC"
+	classIdle        = "idle"
+	classOther       = "other"
+	classUnknown     = "unknown"
+)
+
+// stateClasses maps the states printed by the Go runtime, as of their
+// various versions, to their classes.
+var stateClasses = map[string]string{
+	"running":  classRunning,
+	"runnable": classRunnable,
+	"syscall":  classSyscall,
+	"IO wait":  classBlockedIO,
+
+	"semacquire":          classBlockedLock,
+	"sync.Mutex.Lock":     classBlockedLock,
+	"sync.RWMutex.Lock":   classBlockedLock,
+	"sync.RWMutex.RLock":  classBlockedLock,
+	"sync.WaitGroup.Wait": classBlockedLock,
+	"sync.Cond.Wait":      classBlockedLock,
+
+	"chan receive":            classBlockedChan,
+	"chan send":               classBlockedChan,
+	"chan receive (nil chan)": classBlockedChan,
+	"chan send (nil chan)":    classBlockedChan,
+	"select":                  classBlockedChan,
+	"select (no cases)":       classBlockedChan,
+
+	"sleep": classSleeping,
+
+	"GC assist marking":  classGC,
+	"GC assist wait":     classGC,
+	"GC sweep wait":      classGC,
+	"GC scavenge wait":   classGC,
+	"GC worker (idle)":   classGC,
+	"GC worker (active)": classGC,
+	"force gc (idle)":    classGC,
+	"finalizer wait":     classGC,
+	"wait for GC cycle":  classGC,
+	"garbage collection": classGC,
+	"mark worker (idle)": classGC,
+	"stop the world":     classGC,
+
+	"idle": classIdle,
+
+	"unknown": classUnknown,
+}
+
+// stateIs tells if the goroutine state is name, or of the class name, ignoring
+// case and surrounding spaces.
+func stateIs(state, name string) bool {
+	name = strings.TrimSpace(name)
+	return strings.EqualFold(state, name) || strings.EqualFold(stateClass(state), name)
+}
+
+// stateClass returns the class of a goroutine state.
+func stateClass(state string) string {
+	if class, ok := stateClasses[state]; ok {
+		return class
+	}
+	switch {
+	case state == "":
+		return classUnknown
+	case strings.HasPrefix(state, "chan ") || strings.HasPrefix(state, "select"):
+		return classBlockedChan
+	case strings.HasPrefix(state, "sync."):
+		return classBlockedLock
+	case strings.HasPrefix(state, "GC ") || strings.Contains(state, "gc"):
+		return classGC
+	}
+	return classOther
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// noCreator groups the goroutines without a "created by" frame, such as the
+// main goroutine.
+const noCreator = "(no creator)"
+
+// StuckGroup counts the goroutines of a creator waiting for long.
+type StuckGroup struct {
+	Creator string
+	Count   int
+	Longest int // The longest wait in minutes.
+}
+
+// Stuck groups the goroutines waiting for at least minutes by the function
+// which created them, the largest group first. It also returns the number of
+// stuck goroutines.
+func (gd *GoroutineDump) Stuck(minutes int) ([]StuckGroup, int) {
+	groups := map[string]*StuckGroup{}
+	total := 0
+	add := func(g *Goroutine) {
+		if g.duration < minutes || g.count > 0 {
+			return
+		}
+		creator := noCreator
+		if st := splitStack(g.buf.String()); len(st.creator) > 0 {
+			creator = funcName(st.creator[0])
+			if len(st.creator) > 1 {
+				loc := strings.TrimSpace(st.creator[1])
+				if idx := strings.LastIndex(loc, " +0x"); idx > 0 {
+					loc = loc[:idx]
+				}
+				creator += " " + loc
+			}
+		}
+
+		sg, ok := groups[creator]
+		if !ok {
+			sg = &StuckGroup{Creator: creator}
+			groups[creator] = sg
+		}
+		sg.Count++
+		if g.duration > sg.Longest {
+			sg.Longest = g.duration
+		}
+		total++
+	}
+
+	for _, g := range gd.goroutines {
+		if len(g.members) == 0 {
+			add(g)
+			continue
+		}
+		// The deduped goroutines have the same creator but may have waited
+		// for different durations.
+		for _, m := range g.members {
+			add(m)
+		}
+	}
+
+	stuck := make([]StuckGroup, 0, len(groups))
+	for _, sg := range groups {
+		stuck = append(stuck, *sg)
+	}
+	sort.Slice(stuck, func(i, j int) bool {
+		if stuck[i].Count != stuck[j].Count {
+			return stuck[i].Count > stuck[j].Count
+		}
+		if stuck[i].Longest != stuck[j].Longest {
+			return stuck[i].Longest > stuck[j].Longest
+		}
+		return stuck[i].Creator < stuck[j].Creator
+	})
+	return stuck, total
+}
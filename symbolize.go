@@ -0,0 +1,320 @@
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+var (
+	addrLinePattern = regexp.MustCompile(`^#\t(0x[0-9a-f]+)$`)
+	// pcLinePattern matches the location line of a debug=2 frame with the
+	// offset of its PC from the entry of the function.
+	pcLinePattern = regexp.MustCompile(`^\t.*:\d+ \+(0x[0-9a-f]+)$`)
+)
+
+// binaryPath is the binary set with "set binary", and symbols its debug info.
+var (
+	binaryPath string
+	symbols    *symbolizer
+)
+
+func setBinary(path string) error {
+	if path == "0" {
+		binaryPath, symbols = "", nil
+		return nil
+	}
+	s, err := newSymbolizer(path)
+	if err != nil {
+		return err
+	}
+	binaryPath, symbols = path, s
+	return nil
+}
+
+// symFrame is a function, inlined or not, at a source location.
+type symFrame struct {
+	Function string
+	File     string
+	Line     int
+	Offset   uint64 // From the entry of the function the code is in.
+}
+
+// symbolizer maps the addresses of a binary to its source locations with the
+// DWARF debug info, including the functions inlined at the address.
+type symbolizer struct {
+	data    *dwarf.Data
+	cache   map[uint64][]symFrame
+	entries map[string]uint64 // The entry addresses of the functions by name.
+}
+
+func newSymbolizer(path string) (*symbolizer, error) {
+	var data *dwarf.Data
+	var err error
+	ef, elfErr := elf.Open(path)
+	if elfErr == nil {
+		defer ef.Close()
+		data, err = ef.DWARF()
+	} else if f, e := macho.Open(path); e == nil {
+		defer f.Close()
+		data, err = f.DWARF()
+	} else if f, e := pe.Open(path); e == nil {
+		defer f.Close()
+		data, err = f.DWARF()
+	} else {
+		return nil, fmt.Errorf("%s is not an executable: %s", path, elfErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no debug info in %s, was it built with -ldflags=-w? %s", path, err)
+	}
+	return &symbolizer{data: data, cache: map[uint64][]symFrame{}}, nil
+}
+
+// frames returns the frames at the address, the innermost inlined function
+// first, or nil if the address is not in the binary.
+func (s *symbolizer) frames(pc uint64) []symFrame {
+	if frames, ok := s.cache[pc]; ok {
+		return frames
+	}
+	frames, err := s.lookup(pc)
+	if err != nil {
+		frames = nil
+	}
+	s.cache[pc] = frames
+	return frames
+}
+
+// entry returns the entry address of the function, reading those of all the
+// functions of the binary on first use.
+func (s *symbolizer) entry(function string) (uint64, bool) {
+	if s.entries == nil {
+		s.entries = map[string]uint64{}
+		r := s.data.Reader()
+		for {
+			e, err := r.Next()
+			if err != nil || e == nil {
+				break
+			}
+			if e.Tag != dwarf.TagSubprogram {
+				continue
+			}
+			name, _ := e.Val(dwarf.AttrName).(string)
+			if low, ok := e.Val(dwarf.AttrLowpc).(uint64); ok && name != "" {
+				s.entries[name] = low
+			}
+			if e.Children {
+				r.SkipChildren()
+			}
+		}
+	}
+	pc, ok := s.entries[function]
+	return pc, ok
+}
+
+func (s *symbolizer) lookup(pc uint64) ([]symFrame, error) {
+	r := s.data.Reader()
+	cu, err := r.SeekPC(pc)
+	if err != nil {
+		return nil, err
+	}
+	lr, err := s.data.LineReader(cu)
+	if err != nil || lr == nil {
+		return nil, errors.New("no line table")
+	}
+	var le dwarf.LineEntry
+	if err := lr.SeekPC(pc, &le); err != nil {
+		return nil, err
+	}
+	files := lr.Files()
+
+	// The subprogram holding the address, then the inlined subroutines
+	// holding it, each in the one before.
+	var chain []*dwarf.Entry
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil || e.Tag == 0 {
+			break
+		}
+		switch e.Tag {
+		case dwarf.TagSubprogram, dwarf.TagInlinedSubroutine, dwarf.TagLexDwarfBlock:
+			if s.contains(e, pc) {
+				if e.Tag != dwarf.TagLexDwarfBlock {
+					chain = append(chain, e)
+				}
+				// Look for the subroutines inlined in it.
+				continue
+			}
+		}
+		if e.Children {
+			r.SkipChildren()
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no function")
+	}
+
+	var low uint64
+	if ranges, err := s.data.Ranges(chain[0]); err == nil && len(ranges) > 0 {
+		low = ranges[0][0]
+	}
+	frames := make([]symFrame, len(chain))
+	file, line := le.File.Name, le.Line
+	for i := len(chain) - 1; i >= 0; i-- {
+		e := chain[i]
+		frames[len(chain)-1-i] = symFrame{Function: s.name(e), File: file, Line: line, Offset: pc - low}
+		// The location of the call the subroutine is inlined at.
+		if idx, ok := e.Val(dwarf.AttrCallFile).(int64); ok && int(idx) < len(files) && files[idx] != nil {
+			file = files[idx].Name
+		}
+		if l, ok := e.Val(dwarf.AttrCallLine).(int64); ok {
+			line = int(l)
+		}
+	}
+	return frames, nil
+}
+
+func (s *symbolizer) contains(e *dwarf.Entry, pc uint64) bool {
+	ranges, err := s.data.Ranges(e)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if pc >= r[0] && pc < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// name returns the function name of a subprogram or, for an inlined
+// subroutine, of the subprogram it's an instance of.
+func (s *symbolizer) name(e *dwarf.Entry) string {
+	if name, ok := e.Val(dwarf.AttrName).(string); ok {
+		return name
+	}
+	if off, ok := e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); ok {
+		r := s.data.Reader()
+		r.Seek(off)
+		if origin, err := r.Next(); err == nil && origin != nil {
+			if name, ok := origin.Val(dwarf.AttrName).(string); ok {
+				return name
+			}
+		}
+	}
+	return "?"
+}
+
+// Symbolize resolves the addresses of the debug=1 records left without
+// function and location, as in profiles taken from a binary without symbols.
+// The inlined functions get a frame of their own. In debug=2 stacks, it adds
+// the frames of the functions inlined at a call which the stack lacks, as
+// printed by the runtimes before Go 1.12. It returns the number of goroutines
+// changed.
+func (gd *GoroutineDump) Symbolize(s *symbolizer) int {
+	changed := 0
+	for i, g := range gd.goroutines {
+		if g.external {
+			continue
+		}
+		st := splitStack(g.buf.String())
+		var resolved bool
+		if g.count == 0 {
+			resolved = s.expandInlined(st)
+		} else {
+			resolved = s.resolveAddrs(st)
+		}
+		if !resolved {
+			continue
+		}
+		gd.goroutines[i] = g.withLines(st.lines())
+		changed++
+	}
+	return changed
+}
+
+// resolveAddrs resolves the bare addresses of a debug=1 stack, and tells if
+// any was.
+func (s *symbolizer) resolveAddrs(st *stack) bool {
+	resolved := false
+	frames := make([][]string, 0, len(st.frames))
+	for _, frame := range st.frames {
+		m := addrLinePattern.FindStringSubmatch(frame[0])
+		if m == nil {
+			frames = append(frames, frame)
+			continue
+		}
+		pc, _ := strconv.ParseUint(m[1], 0, 64)
+		found := s.frames(pc)
+		if len(found) == 0 {
+			frames = append(frames, frame)
+			continue
+		}
+		for _, f := range found {
+			frames = append(frames, []string{fmt.Sprintf("#\t%s\t%s+%#x\t%s:%d", m[1], f.Function, f.Offset, f.File, f.Line)})
+		}
+		resolved = true
+	}
+	st.frames = frames
+	return resolved
+}
+
+// expandInlined adds the frames of the functions inlined at the calls of a
+// debug=2 stack which it lacks, and tells if any was added. The PC of a frame
+// is found from the entry of its function and the offset in its location.
+func (s *symbolizer) expandInlined(st *stack) bool {
+	expanded := false
+	frames := make([][]string, 0, len(st.frames))
+	for i, frame := range st.frames {
+		inlined, loc := s.inlinedAt(frame, i == 0)
+		// The runtime may have printed them already.
+		if len(inlined) == 0 || (len(frames) > 0 && funcName(frames[len(frames)-1][0]) == inlined[len(inlined)-1].Function) {
+			frames = append(frames, frame)
+			continue
+		}
+		for _, f := range inlined {
+			frames = append(frames, []string{f.Function + "(...)", fmt.Sprintf("\t%s:%d", f.File, f.Line)})
+		}
+		frames = append(frames, append([]string{frame[0], loc}, frame[2:]...))
+		expanded = true
+	}
+	st.frames = frames
+	return expanded
+}
+
+// inlinedAt returns the functions inlined at the PC of the debug=2 frame, the
+// innermost first, and the location line of the frame in its own function.
+// The PC of the frames below the top one is a return address, its call is
+// the instruction before.
+func (s *symbolizer) inlinedAt(frame []string, top bool) ([]symFrame, string) {
+	if len(frame) < 2 {
+		return nil, ""
+	}
+	m := pcLinePattern.FindStringSubmatch(frame[1])
+	if m == nil {
+		return nil, ""
+	}
+	function := funcName(frame[0])
+	entry, ok := s.entry(function)
+	if !ok {
+		return nil, ""
+	}
+	offset, _ := strconv.ParseUint(m[1], 0, 64)
+	pc := entry + offset
+	if !top && pc > entry {
+		pc--
+	}
+	frames := s.frames(pc)
+	if len(frames) < 2 || frames[len(frames)-1].Function != function {
+		return nil, ""
+	}
+	outer := frames[len(frames)-1]
+	return frames[:len(frames)-1], fmt.Sprintf("\t%s:%d +%s", outer.File, outer.Line, m[1])
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var hasTagPattern = regexp.MustCompile(`(^|[^\w.])has_tag\s*\(`)
+
+func (g *Goroutine) hasTag(name string) bool {
+	for _, t := range g.tags {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Tag labels the goroutines meeting the condition with name. It returns the
+// number of goroutines newly tagged.
+func (gd *GoroutineDump) Tag(cond, name string) (int, error) {
+	name = strings.Trim(name, "\"")
+	if name == "" || strings.ContainsAny(name, "'\"") {
+		return 0, fmt.Errorf("invalid tag %q", name)
+	}
+
+	tagged := 0
+	_, err := gd.withCondition(cond, func(i int, g *Goroutine, passed bool) *Goroutine {
+		if passed && !g.hasTag(name) {
+			// Never append in place, copies of the goroutine made by
+			// truncate() or strip() may share the slice.
+			g.tags = append(g.tags[:len(g.tags):len(g.tags)], name)
+			tagged++
+		}
+		return nil
+	})
+	return tagged, err
+}
+
+// Tagged returns the goroutines labeled with name.
+func (gd GoroutineDump) Tagged(name string) []*Goroutine {
+	name = strings.Trim(name, "\"")
+	var found []*Goroutine
+	for _, g := range gd.goroutines {
+		if g.hasTag(name) {
+			found = append(found, g)
+		}
+	}
+	return found
+}
@@ -0,0 +1,50 @@
+package main
+
+// TrackPoint is the state of a goroutine in one dump of a series.
+type TrackPoint struct {
+	Found    bool
+	State    string
+	Duration int    // In minutes.
+	Frame    string // The function of the top frame.
+	Changed  bool   // The state or the top frame differs from the dump before.
+	Rewound  bool   // The duration is shorter than in the dump before.
+}
+
+// member returns the goroutine id of the dump, a member of its group once
+// deduped, or nil if it's not found.
+func (gd GoroutineDump) member(id int) *Goroutine {
+	for _, g := range gd.goroutines {
+		for _, m := range g.originals() {
+			if m.id == id {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// Track follows the goroutine id over a series of dumps of the same process,
+// in the order they were taken.
+func Track(dumps []*GoroutineDump, id int) []TrackPoint {
+	points := make([]TrackPoint, len(dumps))
+	var last *TrackPoint
+	for i, gd := range dumps {
+		g := gd.member(id)
+		if g == nil {
+			continue
+		}
+		p := &points[i]
+		p.Found = true
+		p.State = g.metas[MetaState]
+		p.Duration = g.duration
+		if st := splitStack(g.buf.String()); len(st.frames) > 0 {
+			p.Frame = funcName(st.frames[0][0])
+		}
+		if last != nil {
+			p.Changed = p.State != last.State || p.Frame != last.Frame
+			p.Rewound = p.Duration < last.Duration
+		}
+		last = p
+	}
+	return points
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// stack is a goroutine trace split into its frames.
+type stack struct {
+	head    []string   // Lines before the first frame, e.g. debug=1 labels.
+	frames  [][]string // Each frame holds its function line and location lines.
+	creator []string   // The "created by" frame, if any.
+	tail    []string   // Trailing blank lines.
+}
+
+func splitStack(trace string) *stack {
+	st := &stack{}
+	lines := strings.Split(strings.TrimSuffix(trace, "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return st
+	}
+
+	var cur *[]string
+	var blanks []string
+	for _, l := range lines {
+		if l == "" {
+			blanks = append(blanks, l)
+			continue
+		}
+		// Only the trailing blank lines go to the tail.
+		if len(blanks) > 0 {
+			if cur == nil {
+				st.head = append(st.head, blanks...)
+			} else {
+				*cur = append(*cur, blanks...)
+			}
+			blanks = nil
+		}
+
+		switch {
+		case strings.HasPrefix(l, "created by "):
+			st.creator = append(st.creator, l)
+			cur = &st.creator
+		case isFrameLine(l):
+			st.frames = append(st.frames, []string{l})
+			cur = &st.frames[len(st.frames)-1]
+		case cur == nil:
+			st.head = append(st.head, l)
+		default:
+			*cur = append(*cur, l)
+		}
+	}
+	st.tail = blanks
+	return st
+}
+
+func (st *stack) lines() []string {
+	lines := make([]string, 0, len(st.head)+2*len(st.frames)+len(st.creator)+len(st.tail))
+	lines = append(lines, st.head...)
+	for _, f := range st.frames {
+		lines = append(lines, f...)
+	}
+	lines = append(lines, st.creator...)
+	return append(lines, st.tail...)
+}
+
+// elideFrames keeps the first and last frames of a stack trace deeper than
+// max frames, and replaces the ones in between with a marker line.
+func elideFrames(trace string, max int) string {
+	st := splitStack(trace)
+	if max <= 0 || len(st.frames) <= max {
+		return trace
+	}
+
+	first, last := (max+1)/2, max/2
+	elided := len(st.frames) - first - last
+	frames := make([][]string, 0, max+1)
+	frames = append(frames, st.frames[:first]...)
+	frames = append(frames, []string{fmt.Sprintf("... %d frames elided ...", elided)})
+	st.frames = append(frames, st.frames[len(st.frames)-last:]...)
+	return strings.Join(st.lines(), "\n") + "\n"
+}
+
+// withLines returns a copy of the goroutine holding the given trace lines. The
+// goroutine itself is left untouched as it may be shared by other dumps.
+func (g *Goroutine) withLines(lines []string) *Goroutine {
+	c := *g
+	c.lines = 1
+	c.frames = 0
+	c.frozen = false
+	c.buf = &bytes.Buffer{}
+	for _, l := range lines {
+		c.AddLine(l)
+	}
+	c.Freeze()
+	return &c
+}
+
+// Truncate cuts the stack traces to the top depth frames, keeping the creator.
+// It returns the number of goroutines changed.
+func (gd *GoroutineDump) Truncate(depth int) int {
+	changed := 0
+	for i, g := range gd.goroutines {
+		if g.external {
+			continue
+		}
+		st := splitStack(g.buf.String())
+		if len(st.frames) <= depth {
+			continue
+		}
+		st.frames = st.frames[:depth]
+		gd.goroutines[i] = g.withLines(st.lines())
+		changed++
+	}
+	return changed
+}
+
+// Strip removes the frames matching the regular expression pattern from the
+// stack traces. It returns the number of goroutines changed.
+func (gd *GoroutineDump) Strip(pattern string) (int, error) {
+	re, err := regexp.Compile(strings.Trim(pattern, "\""))
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for i, g := range gd.goroutines {
+		if g.external {
+			continue
+		}
+		st := splitStack(g.buf.String())
+		frames := st.frames[:0:0]
+		for _, f := range st.frames {
+			if !re.MatchString(strings.Join(f, "\n")) {
+				frames = append(frames, f)
+			}
+		}
+		if len(frames) == len(st.frames) {
+			continue
+		}
+		st.frames = frames
+		gd.goroutines[i] = g.withLines(st.lines())
+		changed++
+	}
+	return changed, nil
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// attachTerminal replaces the standard input with the controlling terminal,
+// once a dump piped into it has been consumed.
+func attachTerminal() error {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+
+	return unix.Dup2(int(tty.Fd()), int(os.Stdin.Fd()))
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+// attachTerminal replaces the standard input with the console, once a dump
+// piped into it has been consumed. It's not supported on Windows.
+func attachTerminal() error {
+	return errors.New("attaching the console is not supported")
+}
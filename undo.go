@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxUndo is the number of changes undo can go back.
+const maxUndo = 20
+
+// undoable are the methods changing a dump in place, which undo can revert.
+var undoable = map[string]bool{
+	"contention": true,
+	"dedupe":     true,
+	"delete":     true,
+	"keep":       true,
+	"keepstate":  true,
+	"newer_than": true,
+	"older_than": true,
+	"strip":      true,
+	"symbolize":  true,
+	"truncate":   true,
+}
+
+// change is a dump var as it was before or after a statement changed it.
+type change struct {
+	name      string
+	statement string
+	dump      *GoroutineDump // The dump changed in place.
+	state     GoroutineDump
+}
+
+var undoStack, redoStack []change
+
+// snapshot returns a copy of the dump sharing its goroutines, which are never
+// changed in place, but not the slice holding them.
+func (gd *GoroutineDump) snapshot() GoroutineDump {
+	s := *gd
+	s.goroutines = append([]*Goroutine(nil), gd.goroutines...)
+	return s
+}
+
+// sameGoroutines tells if the snapshot holds the same goroutines as the dump.
+func (gd *GoroutineDump) sameGoroutines(s GoroutineDump) bool {
+	if len(gd.goroutines) != len(s.goroutines) {
+		return false
+	}
+	for i, g := range gd.goroutines {
+		if s.goroutines[i] != g {
+			return false
+		}
+	}
+	return true
+}
+
+// journal records the state of the dump var before the statement, if the
+// statement changed it.
+func journal(name, statement string, gd *GoroutineDump, before GoroutineDump) {
+	if gd.sameGoroutines(before) {
+		return
+	}
+	undoStack = append(undoStack, change{name: name, statement: statement, dump: gd, state: before})
+	if len(undoStack) > maxUndo {
+		undoStack = undoStack[len(undoStack)-maxUndo:]
+	}
+	redoStack = nil
+}
+
+// undo reverts the last change recorded, or redoes the last one undone if
+// redo is true.
+func undo(redo bool) error {
+	from, to := &undoStack, &redoStack
+	if redo {
+		from, to = to, from
+	}
+	if len(*from) == 0 {
+		if redo {
+			return errors.New("nothing to redo")
+		}
+		return errors.New("nothing to undo")
+	}
+
+	c := (*from)[len(*from)-1]
+	if workspace[c.name] != c.dump {
+		*from = nil
+		return fmt.Errorf("%s was reassigned since %s", c.name, c.statement)
+	}
+	*from = (*from)[:len(*from)-1]
+	*to = append(*to, change{name: c.name, statement: c.statement, dump: c.dump, state: c.dump.snapshot()})
+	*c.dump = c.state
+
+	if redo {
+		fmt.Printf("Redone %s, %s has %d goroutines.\n", c.statement, c.name, len(c.dump.goroutines))
+	} else {
+		fmt.Printf("Undone %s, %s has %d goroutines.\n", c.statement, c.name, len(c.dump.goroutines))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchMaxSignatures limits the stack signatures exported as metrics, the
+// largest ones, to bound the number of series.
+const watchMaxSignatures = 50
+
+// watcher periodically loads a dump and exposes its counts as Prometheus
+// metrics.
+type watcher struct {
+	source string // A pprof URL or a dump file.
+
+	mu      sync.Mutex
+	metrics []byte // The metrics of the last dump loaded.
+	errors  int
+	last    time.Time
+}
+
+// watch loads the dump from source every interval until interrupted, printing
+// the goroutine counts and serving them as metrics on addr if it's not empty.
+func watch(source string, interval time.Duration, addr string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	w := &watcher{source: source}
+	// The metrics server failing, e.g. as the address is in use, ends the
+	// watch with its error.
+	served := make(chan error, 1)
+	if addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("serving metrics: %w", err)
+		}
+		srv := &http.Server{Handler: w}
+		go func() { served <- srv.Serve(ln) }()
+		defer srv.Close()
+		fmt.Printf("Serving metrics on http://%s/metrics\n", addr)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.scrape(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-served:
+			return fmt.Errorf("serving metrics: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *watcher) scrape(ctx context.Context) {
+	dump, err := w.fetch(ctx)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "Error loading %s: %s.\n", w.source, err)
+		}
+		w.errors++
+		return
+	}
+
+	w.last = time.Now()
+	w.metrics = w.render(dump)
+	total, sigs := 0, 0
+	counts, _ := dump.countSignatures()
+	for _, n := range counts {
+		total += n
+		sigs++
+	}
+	fmt.Printf("%s  %d goroutines, %d stack signatures\n", w.last.Format(time.RFC3339), total, sigs)
+}
+
+func (w *watcher) fetch(ctx context.Context) (*GoroutineDump, error) {
+	if !strings.HasPrefix(w.source, "http://") && !strings.HasPrefix(w.source, "https://") {
+		return loadContext(ctx, w.source, nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return parse(resp.Body)
+}
+
+// render formats the metrics of dump in the Prometheus text exposition
+// format.
+func (w *watcher) render(dump *GoroutineDump) []byte {
+	var buf bytes.Buffer
+	counts, samples := dump.countSignatures()
+	total := 0
+	states := map[string]int{}
+	sigs := make([]string, 0, len(counts))
+	for sig, n := range counts {
+		total += n
+		states[samples[sig].metas[MetaState]] += n
+		sigs = append(sigs, sig)
+	}
+
+	fmt.Fprintln(&buf, "# HELP goroutine_inspect_goroutines Number of goroutines in the last dump.")
+	fmt.Fprintln(&buf, "# TYPE goroutine_inspect_goroutines gauge")
+	fmt.Fprintf(&buf, "goroutine_inspect_goroutines %d\n", total)
+
+	fmt.Fprintln(&buf, "# HELP goroutine_inspect_state_goroutines Number of goroutines by state in the last dump.")
+	fmt.Fprintln(&buf, "# TYPE goroutine_inspect_state_goroutines gauge")
+	names := make([]string, 0, len(states))
+	for k := range states {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(&buf, "goroutine_inspect_state_goroutines{state=\"%s\"} %d\n", escapeLabel(k), states[k])
+	}
+
+	sort.Slice(sigs, func(i, j int) bool {
+		if counts[sigs[i]] != counts[sigs[j]] {
+			return counts[sigs[i]] > counts[sigs[j]]
+		}
+		return sigs[i] < sigs[j]
+	})
+	if len(sigs) > watchMaxSignatures {
+		sigs = sigs[:watchMaxSignatures]
+	}
+	fmt.Fprintln(&buf, "# HELP goroutine_inspect_signature_goroutines Number of goroutines of the largest stack signatures in the last dump.")
+	fmt.Fprintln(&buf, "# TYPE goroutine_inspect_signature_goroutines gauge")
+	for _, sig := range sigs {
+		// The signatures are long, label them with a short hash.
+		fmt.Fprintf(&buf, "goroutine_inspect_signature_goroutines{signature=\"%.6x\",function=\"%s\"} %d\n",
+			md5.Sum([]byte(sig)), escapeLabel(samples[sig].leafFunc()), counts[sig])
+	}
+
+	fmt.Fprintln(&buf, "# HELP goroutine_inspect_last_success_timestamp_seconds Time of the last successful load.")
+	fmt.Fprintln(&buf, "# TYPE goroutine_inspect_last_success_timestamp_seconds gauge")
+	fmt.Fprintf(&buf, "goroutine_inspect_last_success_timestamp_seconds %d\n", w.last.Unix())
+	return buf.Bytes()
+}
+
+func (w *watcher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(rw, r)
+		return
+	}
+	w.mu.Lock()
+	metrics, errors := w.metrics, w.errors
+	w.mu.Unlock()
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.Write(metrics)
+	fmt.Fprintln(rw, "# HELP goroutine_inspect_scrape_errors_total Number of failed loads.")
+	fmt.Fprintln(rw, "# TYPE goroutine_inspect_scrape_errors_total counter")
+	fmt.Fprintf(rw, "goroutine_inspect_scrape_errors_total %d\n", errors)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}